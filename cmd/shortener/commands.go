@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/alexdyukov/go-url-shortener/internal/service"
+	"github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+// commands are run once instead of http server, e.g. "shortener -d dsn purge"
+var commands = map[string]func(ctx context.Context, svc service.Repository) error{
+	"purge": purge,
+}
+
+// commandMigrationsTimeout is how long commands wait for storage migrations, which are applied in background
+const commandMigrationsTimeout = time.Minute
+
+func runCommand(ctx context.Context, name string, svc service.Repository) error {
+	command, exist := commands[name]
+	if !exist {
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	if err := waitMigrations(ctx, svc, commandMigrationsTimeout); err != nil {
+		return err
+	}
+
+	return command(ctx, svc)
+}
+
+func waitMigrations(ctx context.Context, svc service.Repository, timeout time.Duration) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for {
+		pending := svc.PendingMigrations(ctx)
+		if len(pending) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("migrations are not applied: %v", pending)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func purge(ctx context.Context, svc service.Repository) error {
+	stats, err := svc.PurgeDeleted(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Println("purged urls:", stats.URLs, "relations:", stats.Relations)
+	return nil
+}
+
+// runMigrate manages database schema before storage is opened, because opening applies every migration,
+// e.g. "shortener -d dsn migrate status", "migrate up" or "migrate down 2"
+func runMigrate(ctx context.Context, dsn string, args []string) error {
+	if dsn == "" {
+		return fmt.Errorf("database DSN is required")
+	}
+
+	migrator, err := storage.NewMigrator(dsn)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	var migrations []storage.MigrationStatus
+	switch action {
+	case "status":
+		migrations, err = migrator.Status(ctx)
+	case "up":
+		migrations, err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to roll back %q", args[1])
+			}
+		}
+		migrations, err = migrator.Down(ctx, steps)
+	default:
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
+
+	for _, m := range migrations {
+		state := "pending"
+		if !m.AppliedAt.IsZero() {
+			state = m.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-24s  %s\n", m.Version, m.Name, state)
+	}
+
+	return err
+}
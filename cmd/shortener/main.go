@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alexdyukov/go-url-shortener/internal/service"
 	"github.com/alexdyukov/go-url-shortener/internal/storage"
@@ -13,25 +19,107 @@ import (
 func main() {
 	conf := webconfig.GetConfig()
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(context.Background(), conf.DataBaseDSN.String(), flag.Args()[1:]); err != nil {
+			log.Fatal("migrate: ", err.Error())
+		}
+		return
+	}
+
+	storOpts := []storage.Option{storage.WithIDStrategy(conf.IDStrategy.Strategy())}
+
 	var stor storage.Storage
 	switch {
 	case conf.DataBaseDSN != "":
-		s, err := storage.NewInDatabase(conf.DataBaseDSN.String())
+		s, err := storage.NewInDatabase(conf.DataBaseDSN.String(), storOpts...)
 		if err != nil {
 			log.Fatal("cannot open database connection:", err.Error())
 		}
 		stor = s
 	case conf.FileStoragePath != "":
-		s, err := storage.NewInFile(conf.FileStoragePath.String())
+		s, err := storage.NewInFile(conf.FileStoragePath.String(), storOpts...)
 		if err != nil {
 			log.Fatal("cannot open storage file:", err.Error())
 		}
 		stor = s
 	default:
-		stor = storage.NewInMemory()
+		stor = storage.NewInMemory(storOpts...)
+	}
+	svc := service.NewURLShortener(stor, conf.BaseURL.String(),
+		service.WithCodec(conf.ShortCodec.Codec()),
+		service.WithAnalyticsRetention(conf.AnalyticsRetention.Duration()),
+		service.WithRestoreWindow(conf.RestoreWindow.Duration()),
+		service.WithPurge(conf.PurgeAfter.Duration(), conf.PurgeKeepBlocked.Bool()),
+	)
+
+	if name := flag.Arg(0); name != "" {
+		err := runCommand(context.Background(), name, svc)
+
+		// log.Fatal skips deferred calls, so storage workers are stopped before
+		closeCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout.Duration())
+		if closeErr := svc.Close(closeCtx); closeErr != nil {
+			log.Println("cannot close service:", closeErr.Error())
+		}
+		cancel()
+
+		if err != nil {
+			log.Fatal(name, ": ", err.Error())
+		}
+		return
+	}
+
+	wh := webhandler.NewWebHandler(svc, encryptKeys(conf))
+	server := &http.Server{Addr: conf.ServerAddress.String(), Handler: wh.HTTPRouter()}
+
+	servers := []*http.Server{server}
+
+	serve := server.ListenAndServe
+	if conf.EnableHTTPS.Bool() {
+		s, err := serveTLS(server, conf)
+		if err != nil {
+			log.Fatal("cannot configure https:", err.Error())
+		}
+		serve = s
+
+		if conf.HTTPRedirectAddr != "" {
+			redirect := &http.Server{Addr: conf.HTTPRedirectAddr.String(), Handler: redirectHTTPS(svc)}
+			servers = append(servers, redirect)
+			go listen(redirect.ListenAndServe)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go listen(serve)
+	go watchReload(ctx, conf, svc, wh)
+	<-ctx.Done()
+
+	// drain in-flight requests and queued work, e.g. deletes, before exit
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout.Duration())
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("cannot shutdown http server:", err.Error())
+		}
+	}
+	if err := svc.Close(shutdownCtx); err != nil {
+		log.Println("cannot close service:", err.Error())
+	}
+}
+
+func listen(serve func() error) {
+	if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+func encryptKeys(conf *webconfig.Config) []webhandler.EncryptKey {
+	keys := []webhandler.EncryptKey{}
+	for _, key := range conf.EncryptKey.Keys() {
+		keys = append(keys, webhandler.EncryptKey{ID: key.ID, Key: key.Key})
 	}
-	svc := service.NewURLShortener(stor, conf.BaseURL.String())
-	wh := webhandler.NewWebHandler(svc, conf.EncryptKey.String())
 
-	log.Fatal(http.ListenAndServe(conf.ServerAddress.String(), wh.HTTPRouter()))
+	return keys
 }
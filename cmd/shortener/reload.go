@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/alexdyukov/go-url-shortener/cmd/webconfig"
+	"github.com/alexdyukov/go-url-shortener/internal/service"
+	"github.com/alexdyukov/go-url-shortener/internal/webhandler"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchReload reloads configuration on SIGHUP and config file change until ctx is done
+func watchReload(ctx context.Context, conf *webconfig.Config, svc service.Repository, wh *webhandler.WebHandler) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// nil channels block forever, so without watcher config is reloaded on SIGHUP only
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher := watchConfigDir(conf.ConfigFile)
+	if watcher != nil {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+
+	// config file may be a symlink swapped by deployment tools, e.g. kubernetes ConfigMap,
+	// so its target is tracked too
+	target := configTarget(conf.ConfigFile)
+
+	for {
+		select {
+		case <-hup:
+		case event := <-events:
+			changed := configTarget(conf.ConfigFile)
+			if filepath.Clean(event.Name) != filepath.Clean(conf.ConfigFile) && changed == target {
+				continue
+			}
+			target = changed
+		case err := <-errs:
+			log.Println("reload: config file watcher error:", err.Error())
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		reload(conf, svc, wh)
+	}
+}
+
+// watchConfigDir watches directory of config file, because editors and deployment tools
+// replace the file, so watch of the file itself is lost
+func watchConfigDir(path string) *fsnotify.Watcher {
+	if path == "" {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("reload: cannot watch config file, reload on SIGHUP only:", err.Error())
+		return nil
+	}
+
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		log.Println("reload: cannot watch config file, reload on SIGHUP only:", err.Error())
+		watcher.Close()
+		return nil
+	}
+
+	return watcher
+}
+
+// configTarget returns path config file resolves to, empty one while it is missing
+func configTarget(path string) string {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return ""
+	}
+
+	return target
+}
+
+// reload applies reloadable parameters, changes of other ones are applied on restart only
+func reload(conf *webconfig.Config, svc service.Repository, wh *webhandler.WebHandler) {
+	reloaded, err := webconfig.Reload()
+	if err != nil {
+		log.Println("reload: invalid config, current one is kept:", err.Error())
+		return
+	}
+
+	for _, name := range conf.Unreloadable(reloaded) {
+		log.Println("reload: change of", name, "requires restart, it is ignored")
+	}
+
+	if err := wh.Reload(encryptKeys(reloaded)); err != nil {
+		log.Println("reload: invalid encrypt key, current config is kept:", err.Error())
+		return
+	}
+	svc.Reload(service.Settings{
+		BaseURL:       reloaded.BaseURL.String(),
+		RestoreWindow: reloaded.RestoreWindow.Duration(),
+		KeepBlocked:   reloaded.PurgeKeepBlocked.Bool(),
+	})
+
+	log.Println("reload: config reloaded")
+}
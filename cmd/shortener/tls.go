@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/alexdyukov/go-url-shortener/cmd/webconfig"
+	"github.com/alexdyukov/go-url-shortener/internal/service"
+)
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// serveTLS prepares https serving of server, certificate is self-signed for base url host
+// unless certificate and key files are given
+func serveTLS(server *http.Server, conf *webconfig.Config) (func() error, error) {
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	certFile, keyFile := conf.TLSCertFile.String(), conf.TLSKeyFile.String()
+	if certFile != "" {
+		// certificate is loaded on start, so invalid files are reported before serving
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+
+		return func() error {
+			return server.ListenAndServeTLS("", "")
+		}, nil
+	}
+
+	baseURL, err := url.Parse(conf.BaseURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := selfSignedCertificate(baseURL.Hostname(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	log.Println("no tls certificate given, serving self-signed one for", baseURL.Hostname(), "which is suitable for local development only")
+
+	server.TLSConfig.Certificates = []tls.Certificate{cert}
+
+	return func() error {
+		return server.ListenAndServeTLS("", "")
+	}, nil
+}
+
+func selfSignedCertificate(host string, now time.Time) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"go-url-shortener"}, CommonName: host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// redirectHTTPS redirects plain http requests to the same path of base url of current settings,
+// so reloaded base url is applied at once. Permanent redirect keeps method and body of api requests
+func redirectHTTPS(svc service.Repository) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, err := url.Parse(svc.Settings().BaseURL)
+		if err != nil {
+			log.Println("redirect: invalid base url:", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		redirect := *target
+		redirect.Path = r.URL.Path
+		redirect.RawPath = r.URL.RawPath
+		redirect.RawQuery = r.URL.RawQuery
+		http.Redirect(w, r, redirect.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alexdyukov/go-url-shortener/cmd/webconfig"
+	"github.com/alexdyukov/go-url-shortener/internal/service"
+	"github.com/alexdyukov/go-url-shortener/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		host string
+		dns  []string
+		ips  []net.IP
+	}{
+		{
+			name: "host name",
+			host: "localhost",
+			dns:  []string{"localhost"},
+		},
+		{
+			name: "ip address",
+			host: "127.0.0.1",
+			ips:  []net.IP{net.ParseIP("127.0.0.1")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := selfSignedCertificate(tt.host, now)
+			if !assert.Nil(t, err) || !assert.Len(t, cert.Certificate, 1) {
+				return
+			}
+
+			parsed, err := x509.ParseCertificate(cert.Certificate[0])
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, tt.host, parsed.Subject.CommonName)
+			assert.Equal(t, tt.dns, parsed.DNSNames)
+			assert.Equal(t, len(tt.ips), len(parsed.IPAddresses))
+			for i := range tt.ips {
+				assert.True(t, tt.ips[i].Equal(parsed.IPAddresses[i]))
+			}
+			assert.True(t, parsed.NotBefore.Before(now))
+			assert.True(t, parsed.NotAfter.After(now.Add(selfSignedValidity-time.Minute)))
+			assert.Nil(t, parsed.VerifyHostname(tt.host))
+		})
+	}
+}
+
+// writeCertificate writes PEM encoded self-signed certificate and its key into dir
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	cert, err := selfSignedCertificate("localhost", time.Now())
+	assert.Nil(t, err)
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	assert.Nil(t, os.WriteFile(invalidFile, []byte("not a pem"), 0600))
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{
+			name:     "certificate files",
+			certFile: certFile,
+			keyFile:  keyFile,
+		},
+		{
+			name: "self-signed certificate",
+		},
+		{
+			name:     "invalid certificate file",
+			certFile: invalidFile,
+			keyFile:  keyFile,
+			wantErr:  true,
+		},
+		{
+			name:     "invalid key file",
+			certFile: certFile,
+			keyFile:  invalidFile,
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &webconfig.Config{
+				BaseURL:     webconfig.BaseURL("https://localhost:8443"),
+				TLSCertFile: webconfig.TLSFile(tt.certFile),
+				TLSKeyFile:  webconfig.TLSFile(tt.keyFile),
+			}
+			server := &http.Server{}
+
+			serve, err := serveTLS(server, conf)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.NotNil(t, serve)
+			if assert.NotNil(t, server.TLSConfig) {
+				assert.Equal(t, uint16(tls.VersionTLS12), server.TLSConfig.MinVersion)
+				assert.Len(t, server.TLSConfig.Certificates, 1)
+			}
+		})
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	svc := service.NewURLShortener(storage.NewInMemory(), "https://localhost:8443")
+	defer svc.Close(context.Background())
+	handler := redirectHTTPS(svc)
+
+	redirect := func() string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://localhost:8080/api/shorten?q=1", nil))
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		return w.Header().Get("Location")
+	}
+
+	assert.Equal(t, "https://localhost:8443/api/shorten?q=1", redirect())
+
+	// reloaded base url is applied without restart
+	settings := svc.Settings()
+	settings.BaseURL = "https://short.example.com"
+	svc.Reload(settings)
+	assert.Equal(t, "https://short.example.com/api/shorten?q=1", redirect())
+}
@@ -0,0 +1,89 @@
+package webconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// readConfigFile returns values of JSON or YAML config file keyed by env names,
+// e.g. "base_url" key is BASE_URL. Values are validated by Set of their parameters
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s: should be .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	params := configParams()
+	result := map[string]string{}
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		paramType, exist := params[name]
+		if !exist {
+			return nil, fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+
+		str, err := configValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: key %q: %w", path, key, err)
+		}
+
+		param := reflect.New(paramType).Interface().(flag.Value)
+		if err := param.Set(str); err != nil {
+			return nil, fmt.Errorf("config file %s: key %q: %w", path, key, err)
+		}
+
+		result[name] = str
+	}
+
+	return result, nil
+}
+
+// configParams returns types of Config parameters by their env names
+func configParams() map[string]reflect.Type {
+	flagValue := reflect.TypeOf((*flag.Value)(nil)).Elem()
+
+	result := map[string]reflect.Type{}
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name := field.Tag.Get("env")
+		if name == "" || !reflect.PointerTo(field.Type).Implements(flagValue) {
+			continue
+		}
+		result[name] = field.Type
+	}
+
+	return result
+}
+
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", errors.New("should be string, number or boolean")
+	}
+}
@@ -0,0 +1,35 @@
+package webconfig
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type Bool bool
+
+func (b *Bool) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
+
+func (b *Bool) String() string {
+	return strconv.FormatBool(bool(*b))
+}
+
+func (b *Bool) Set(value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+
+	*b = Bool(parsed)
+	return nil
+}
+
+// IsBoolFlag allows "-flag" without value in command line
+func (b *Bool) IsBoolFlag() bool {
+	return true
+}
+
+func (b *Bool) Bool() bool {
+	return bool(*b)
+}
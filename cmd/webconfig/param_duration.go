@@ -0,0 +1,50 @@
+package webconfig
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration accepts time.ParseDuration values and whole days like "90d"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+func (d *Duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *Duration) Set(value string) error {
+	parsed, err := parseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+	if parsed < 0 {
+		return errors.New("should not be negative")
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d *Duration) Duration() time.Duration {
+	return time.Duration(*d)
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if !strings.HasSuffix(value, "d") {
+		return time.ParseDuration(value)
+	}
+
+	days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(days) * 24 * time.Hour, nil
+}
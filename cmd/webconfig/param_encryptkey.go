@@ -1,12 +1,29 @@
 package webconfig
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 )
 
+// DefaultEncryptKey is allowed in dev mode only
+const DefaultEncryptKey = "testtesttesttest"
+
+var keyIDPattern = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+// EncryptKey is key ring of user cookies "id:key,id:key" ordered from the newest key.
+// Value, which is not such ring, is single legacy key, even with ':' inside, its id is derived from the key
 type EncryptKey string
 
+// Key is AES-128, AES-192 or AES-256 key with its ID
+type Key struct {
+	ID  string
+	Key []byte
+}
+
 func (ek *EncryptKey) UnmarshalText(text []byte) error {
 	return ek.Set(string(text))
 }
@@ -16,10 +33,57 @@ func (ek *EncryptKey) String() string {
 }
 
 func (ek *EncryptKey) Set(value string) error {
-	if len(value) != 16 {
-		return errors.New("invalid encrypt key")
+	if _, err := parseKeyRing(value); err != nil {
+		return err
 	}
 
 	*ek = EncryptKey(value)
 	return nil
 }
+
+// Keys returns key ring from the newest key
+func (ek *EncryptKey) Keys() []Key {
+	keys, _ := parseKeyRing(string(*ek))
+	return keys
+}
+
+func parseKeyRing(value string) ([]Key, error) {
+	keys, err := parseIDKeys(value)
+	if err == nil {
+		return keys, nil
+	}
+
+	if !validKeyLength(value) {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(value))
+	return []Key{{ID: hex.EncodeToString(sum[:4]), Key: []byte(value)}}, nil
+}
+
+// parseIDKeys parses "id:key,id:key" ring, every key should have id
+func parseIDKeys(value string) ([]Key, error) {
+	keys := []Key{}
+	ids := map[string]struct{}{}
+	for _, entry := range strings.Split(value, ",") {
+		id, k, found := strings.Cut(entry, ":")
+		if !found || !keyIDPattern.MatchString(id) {
+			return nil, errors.New("invalid encrypt key, should be single key or \"id:key\" entries")
+		}
+		if !validKeyLength(k) {
+			return nil, errors.New("invalid encrypt key, should be 16, 24 or 32 bytes")
+		}
+
+		if _, exist := ids[id]; exist {
+			return nil, fmt.Errorf("duplicate encrypt key id %q", id)
+		}
+		ids[id] = struct{}{}
+		keys = append(keys, Key{ID: id, Key: []byte(k)})
+	}
+
+	return keys, nil
+}
+
+func validKeyLength(key string) bool {
+	l := len(key)
+	return l == 16 || l == 24 || l == 32
+}
@@ -0,0 +1,82 @@
+package webconfig
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func derivedKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+func TestEncryptKey_Keys(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []Key
+		wantErr bool
+	}{
+		{
+			name:  "single key",
+			value: "0123456789abcdef",
+			want:  []Key{{ID: derivedKeyID("0123456789abcdef"), Key: []byte("0123456789abcdef")}},
+		},
+		{
+			name:  "key with id of 24 bytes in total",
+			value: "primary:0123456789abcdef",
+			want:  []Key{{ID: "primary", Key: []byte("0123456789abcdef")}},
+		},
+		{
+			name:  "key with id of 32 bytes in total",
+			value: "rotation-key-02:0123456789abcdef",
+			want:  []Key{{ID: "rotation-key-02", Key: []byte("0123456789abcdef")}},
+		},
+		{
+			name:  "key ring",
+			value: "new:0123456789abcdef0123456789abcdef,old:fedcba9876543210",
+			want:  []Key{{ID: "new", Key: []byte("0123456789abcdef0123456789abcdef")}, {ID: "old", Key: []byte("fedcba9876543210")}},
+		},
+		{
+			name:  "legacy key with separator",
+			value: "ab:0123456789abc",
+			want:  []Key{{ID: derivedKeyID("ab:0123456789abc"), Key: []byte("ab:0123456789abc")}},
+		},
+		{
+			name:    "key of invalid length",
+			value:   "0123456789",
+			wantErr: true,
+		},
+		{
+			name:    "key ring with key of invalid length",
+			value:   "new:0123456789abcdef,old:0123456789",
+			wantErr: true,
+		},
+		{
+			name:    "key ring with key without id",
+			value:   "new:0123456789abcdef,fedcba9876543210",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate id",
+			value:   "new:0123456789abcdef,new:fedcba9876543210",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ek EncryptKey
+			err := ek.Set(tt.value)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, ek.Keys())
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package webconfig
+
+import (
+	"fmt"
+
+	"github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+type IDStrategy string
+
+func (ids *IDStrategy) UnmarshalText(text []byte) error {
+	return ids.Set(string(text))
+}
+
+func (ids *IDStrategy) String() string {
+	return fmt.Sprint(*ids)
+}
+
+func (ids *IDStrategy) Set(value string) error {
+	if _, err := storage.ParseIDStrategy(value); err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+
+	*ids = IDStrategy(value)
+	return nil
+}
+
+func (ids *IDStrategy) Strategy() storage.IDStrategy {
+	strategy, _ := storage.ParseIDStrategy(ids.String())
+	return strategy
+}
@@ -0,0 +1,28 @@
+package webconfig
+
+import "fmt"
+
+// RedirectAddress is listen address of plain http server redirecting to https, empty one disables it
+type RedirectAddress string
+
+func (ra *RedirectAddress) UnmarshalText(text []byte) error {
+	return ra.Set(string(text))
+}
+
+func (ra *RedirectAddress) String() string {
+	return fmt.Sprint(*ra)
+}
+
+func (ra *RedirectAddress) Set(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	var sa ServerAddress
+	if err := sa.Set(value); err != nil {
+		return err
+	}
+
+	*ra = RedirectAddress(value)
+	return nil
+}
@@ -0,0 +1,31 @@
+package webconfig
+
+import (
+	"fmt"
+
+	"github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+type ShortCodec string
+
+func (sc *ShortCodec) UnmarshalText(text []byte) error {
+	return sc.Set(string(text))
+}
+
+func (sc *ShortCodec) String() string {
+	return fmt.Sprint(*sc)
+}
+
+func (sc *ShortCodec) Set(value string) error {
+	if _, err := storage.NewCodec(value); err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+
+	*sc = ShortCodec(value)
+	return nil
+}
+
+func (sc *ShortCodec) Codec() storage.Codec {
+	codec, _ := storage.NewCodec(sc.String())
+	return codec
+}
@@ -0,0 +1,29 @@
+package webconfig
+
+import (
+	"fmt"
+	"os"
+)
+
+// TLSFile is path to existing PEM encoded certificate or key, empty one is allowed
+type TLSFile string
+
+func (tf *TLSFile) UnmarshalText(text []byte) error {
+	return tf.Set(string(text))
+}
+
+func (tf *TLSFile) String() string {
+	return fmt.Sprint(*tf)
+}
+
+func (tf *TLSFile) Set(value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, err := os.Stat(value); err != nil {
+		return fmt.Errorf("invalid tls file path: %w", err)
+	}
+
+	*tf = TLSFile(value)
+	return nil
+}
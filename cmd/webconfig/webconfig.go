@@ -1,39 +1,196 @@
 package webconfig
 
 import (
+	"errors"
 	"flag"
+	"io"
 	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
 
 	env "github.com/caarlos0/env/v6"
 )
 
 type Config struct {
-	once            sync.Once
-	ServerAddress   ServerAddress   `env:"SERVER_ADDRESS" envDefault:":8080" envExpand:"true"`
-	BaseURL         BaseURL         `env:"BASE_URL" envDefault:"http://localhost:8080" envExpand:"true"`
-	FileStoragePath FileStoragePath `env:"FILE_STORAGE_PATH" envDefault:"" envExpand:"true"`
-	EncryptKey      EncryptKey      `env:"ENCRYPT_KEY" envDefault:"testtesttesttest" envExpand:"true"`
-	DataBaseDSN     DataBaseDSN     `env:"DATABASE_DSN" envDefault:"" envExpand:"true"`
+	once               sync.Once
+	ConfigFile         string          `env:"CONFIG"`
+	ServerAddress      ServerAddress   `env:"SERVER_ADDRESS" envDefault:":8080" envExpand:"true"`
+	BaseURL            BaseURL         `env:"BASE_URL" envDefault:"http://localhost:8080" envExpand:"true"`
+	FileStoragePath    FileStoragePath `env:"FILE_STORAGE_PATH" envDefault:"" envExpand:"true"`
+	EncryptKey         EncryptKey      `env:"ENCRYPT_KEY" envDefault:"testtesttesttest" envExpand:"true"`
+	DevMode            Bool            `env:"DEV_MODE" envDefault:"false" envExpand:"true"`
+	DataBaseDSN        DataBaseDSN     `env:"DATABASE_DSN" envDefault:"" envExpand:"true"`
+	ShortCodec         ShortCodec      `env:"SHORT_CODEC" envDefault:"base62" envExpand:"true"`
+	IDStrategy         IDStrategy      `env:"ID_STRATEGY" envDefault:"hash" envExpand:"true"`
+	AnalyticsRetention Duration        `env:"ANALYTICS_RETENTION" envDefault:"90d" envExpand:"true"`
+	RestoreWindow      Duration        `env:"RESTORE_WINDOW" envDefault:"7d" envExpand:"true"`
+	PurgeAfter         Duration        `env:"PURGE_AFTER" envDefault:"30d" envExpand:"true"`
+	PurgeKeepBlocked   Bool            `env:"PURGE_KEEP_BLOCKED" envDefault:"true" envExpand:"true"`
+	ShutdownTimeout    Duration        `env:"SHUTDOWN_TIMEOUT" envDefault:"30s" envExpand:"true"`
+	EnableHTTPS        Bool            `env:"ENABLE_HTTPS" envDefault:"false" envExpand:"true"`
+	TLSCertFile        TLSFile         `env:"TLS_CERT_FILE" envDefault:"" envExpand:"true"`
+	TLSKeyFile         TLSFile         `env:"TLS_KEY_FILE" envDefault:"" envExpand:"true"`
+	HTTPRedirectAddr   RedirectAddress `env:"HTTP_REDIRECT_ADDRESS" envDefault:"" envExpand:"true"`
 }
 
 var config Config
 
+// reloadable are env names of parameters, which are applied without restart
+var reloadable = map[string]bool{
+	"CONFIG":             true,
+	"BASE_URL":           true,
+	"ENCRYPT_KEY":        true,
+	"RESTORE_WINDOW":     true,
+	"PURGE_KEEP_BLOCKED": true,
+}
+
 func init() {
-	flag.Var(&config.ServerAddress, "a", "http listen address ")
-	flag.Var(&config.BaseURL, "b", "base url for shortener")
-	flag.Var(&config.FileStoragePath, "f", "path to storage file")
-	flag.Var(&config.EncryptKey, "k", "16 bit encrypt key for auth cookie")
-	flag.Var(&config.DataBaseDSN, "d", "database DSN link")
+	config.bind(flag.CommandLine)
+}
+
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "c", "", "path to JSON or YAML config file, its values are overridden by env and flags")
+	fs.Var(&c.ServerAddress, "a", "http listen address ")
+	fs.Var(&c.BaseURL, "b", "base url for shortener")
+	fs.Var(&c.FileStoragePath, "f", "path to storage file")
+	fs.Var(&c.EncryptKey, "k", "auth cookie encrypt key or keys \"id:key,id:key\" from the newest one, keys are 16, 24 or 32 bytes")
+	fs.Var(&c.DevMode, "dev", "allow insecure defaults for local development, e.g. default encrypt key")
+	fs.Var(&c.DataBaseDSN, "d", "database DSN link")
+	fs.Var(&c.ShortCodec, "e", "short id encoding: base62, base58 or base32")
+	fs.Var(&c.IDStrategy, "g", "short id generation strategy: hash, sequential or random")
+	fs.Var(&c.AnalyticsRetention, "r", "click events retention, e.g. 90d or 720h")
+	fs.Var(&c.RestoreWindow, "w", "how long deleted urls may be restored, e.g. 7d or 48h")
+	fs.Var(&c.PurgeAfter, "p", "how long deleted urls are kept before purge, 0 disables periodic purge")
+	fs.Var(&c.PurgeKeepBlocked, "B", "keep short ids of purged urls blocked from reuse")
+	fs.Var(&c.ShutdownTimeout, "t", "how long shutdown waits for in-flight requests and background writes")
+	fs.Var(&c.EnableHTTPS, "s", "serve https, self-signed certificate is generated without certificate and key files in dev mode")
+	fs.Var(&c.TLSCertFile, "tls-cert", "path to PEM encoded tls certificate")
+	fs.Var(&c.TLSKeyFile, "tls-key", "path to PEM encoded tls key")
+	fs.Var(&c.HTTPRedirectAddr, "http-redirect", "listen address of plain http server redirecting to https")
 }
 
 func GetConfig() *Config {
 	config.once.Do(func() {
-		if err := env.Parse(&config); err != nil {
+		flag.Parse()
+		if err := config.load(flag.CommandLine); err != nil {
 			log.Fatal(err)
 		}
-		flag.Parse()
 	})
 
 	return &config
 }
+
+// Reload parses configuration again, e.g. on config file change. Env and command line
+// are the same as on start, so they still take precedence over config file
+func Reload() (*Config, error) {
+	reloaded := &Config{}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	reloaded.bind(fs)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	if err := reloaded.load(fs); err != nil {
+		return nil, err
+	}
+
+	return reloaded, nil
+}
+
+// Unreloadable returns env names of parameters, which differ in reloaded config,
+// but are applied on restart only
+func (c *Config) Unreloadable(reloaded *Config) []string {
+	result := []string{}
+
+	current, changed := reflect.ValueOf(c).Elem(), reflect.ValueOf(reloaded).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		name := current.Type().Field(i).Tag.Get("env")
+		if name == "" || reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), changed.Field(i).Interface()) {
+			result = append(result, name)
+		}
+	}
+
+	return result
+}
+
+// load fills c by config file, env and parsed flags of fs, later ones take precedence
+func (c *Config) load(fs *flag.FlagSet) error {
+	// flags are set again after env
+	flags := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+
+	path := c.ConfigFile
+	if path == "" {
+		path = os.Getenv("CONFIG")
+	}
+
+	environment := map[string]string{}
+	if path != "" {
+		fromFile, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		environment = fromFile
+	}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		environment[name] = value
+	}
+
+	if err := env.Parse(c, env.Options{Environment: environment}); err != nil {
+		return err
+	}
+	for name, value := range flags {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+
+	return c.validate()
+}
+
+// validate checks parameters, which depend on each other
+func (c *Config) validate() error {
+	if !c.DevMode.Bool() {
+		for _, key := range c.EncryptKey.Keys() {
+			if string(key.Key) == DefaultEncryptKey {
+				return errors.New("default encrypt key is allowed in dev mode only, set ENCRYPT_KEY or DEV_MODE")
+			}
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls certificate and key files should be set together")
+	}
+
+	if !c.EnableHTTPS.Bool() {
+		if c.TLSCertFile != "" || c.HTTPRedirectAddr != "" {
+			return errors.New("tls files and http redirect require https enabled")
+		}
+		return nil
+	}
+
+	if c.TLSCertFile == "" && !c.DevMode.Bool() {
+		return errors.New("self-signed certificate is allowed in dev mode only, set tls certificate and key files or DEV_MODE")
+	}
+
+	baseURL, err := url.Parse(c.BaseURL.String())
+	if err != nil {
+		return err
+	}
+	if baseURL.Scheme != "https" {
+		return errors.New("base url should have https scheme, when https is enabled")
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package webconfig
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testEncryptKey = EncryptKey("0123456789abcdef")
+
+func TestConfig_ValidateTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{
+			name:   "plain http",
+			config: &Config{BaseURL: "http://localhost:8080"},
+		},
+		{
+			name:   "certificate files",
+			config: &Config{BaseURL: "https://localhost:8443", EnableHTTPS: true, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+		},
+		{
+			name:   "redirect of plain http",
+			config: &Config{BaseURL: "https://localhost:8443", EnableHTTPS: true, TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", HTTPRedirectAddr: ":8080"},
+		},
+		{
+			name:   "self-signed certificate in dev mode",
+			config: &Config{BaseURL: "https://localhost:8443", EnableHTTPS: true, DevMode: true},
+		},
+		{
+			name:    "self-signed certificate outside dev mode",
+			config:  &Config{BaseURL: "https://localhost:8443", EnableHTTPS: true},
+			wantErr: true,
+		},
+		{
+			name:    "certificate without key",
+			config:  &Config{BaseURL: "https://localhost:8443", EnableHTTPS: true, TLSCertFile: "cert.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "certificate files without https",
+			config:  &Config{BaseURL: "http://localhost:8080", TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "redirect without https",
+			config:  &Config{BaseURL: "http://localhost:8080", HTTPRedirectAddr: ":8081"},
+			wantErr: true,
+		},
+		{
+			name:    "http base url with https",
+			config:  &Config{BaseURL: "http://localhost:8443", EnableHTTPS: true, DevMode: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.EncryptKey = testEncryptKey
+			err := tt.config.validate()
+			if tt.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_Load(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "json config file",
+			file:    "config.json",
+			content: `{"base_url": "http://file:8080", "server_address": ":8081", "restore_window": "1d", "dev_mode": true}`,
+		},
+		{
+			name:    "yaml config file",
+			file:    "config.yaml",
+			content: "base_url: http://file:8080\nserver_address: \":8081\"\nrestore_window: 1d\ndev_mode: true\n",
+		},
+		{
+			name:    "unknown key",
+			file:    "config.json",
+			content: `{"base_url": "http://file:8080", "unknown": "value"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			file:    "config.yml",
+			content: "restore_window: never\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			file:    "config.toml",
+			content: `base_url = "http://file:8080"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			assert.Nil(t, os.WriteFile(path, []byte(tt.content), 0600))
+
+			// config file is the lowest layer, env overrides it and flags override env
+			t.Setenv("CONFIG", path)
+			t.Setenv("SERVER_ADDRESS", ":8082")
+			t.Setenv("BASE_URL", "http://env:8080")
+
+			c := &Config{}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			c.bind(fs)
+			assert.Nil(t, fs.Parse([]string{"-b", "http://flag:8080"}))
+
+			err := c.load(fs)
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			if !assert.Nil(t, err) {
+				return
+			}
+			assert.Equal(t, "http://flag:8080", c.BaseURL.String())
+			assert.Equal(t, ":8082", c.ServerAddress.String())
+			assert.Equal(t, 24*time.Hour, c.RestoreWindow.Duration())
+			assert.True(t, c.DevMode.Bool())
+			// defaults fill parameters missing in all layers
+			assert.Equal(t, 30*24*time.Hour, c.PurgeAfter.Duration())
+		})
+	}
+}
@@ -11,6 +11,8 @@ require (
 	github.com/jackc/pgx/v4 v4.16.1
 	github.com/shomali11/util v0.0.0-20200329021417-91c54758c87b
 	github.com/stretchr/testify v1.7.1
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -22,10 +24,8 @@ require (
 	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
 	github.com/jackc/pgtype v1.11.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e // indirect
 	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
 	golang.org/x/text v0.3.7 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
 
 replace github.com/alexdyukov/go-url-shortener/internal/service => ./internal/service
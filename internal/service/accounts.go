@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores bytes after 72th
+	maxPasswordLength = 72
+)
+
+var loginPattern = regexp.MustCompile(`^[a-z0-9._@-]{3,64}$`)
+
+// missingAccountHash is compared with password of unknown login,
+// so response time does not reveal registered logins, it is generated on the first use to keep startup fast
+var (
+	missingAccountHash     []byte
+	missingAccountHashOnce sync.Once
+)
+
+func (u *URLShortener) Register(ctx context.Context, creds Credentials) (Account, error) {
+	user, err := storage.GetUser(ctx)
+	if err != nil || user == storage.DefaultUser {
+		return Account{}, storage.ErrInvalidUser{}
+	}
+
+	login, err := parseCredentials(creds)
+	if err != nil {
+		return Account{}, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, err
+	}
+
+	account := storage.Account{Login: login, User: user, PasswordHash: string(hash), CreatedAt: time.Now()}
+	if err := u.stor.SaveAccount(ctx, account); err != nil {
+		return Account{}, err
+	}
+
+	return Account{Login: account.Login, CreatedAt: account.CreatedAt}, nil
+}
+
+func (u *URLShortener) Login(ctx context.Context, creds Credentials) (storage.User, error) {
+	login, err := parseCredentials(creds)
+	if err != nil {
+		return storage.DefaultUser, err
+	}
+
+	account, err := u.stor.GetAccount(ctx, login)
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		missingAccountHashOnce.Do(func() {
+			missingAccountHash, _ = bcrypt.GenerateFromPassword([]byte("missing account password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(missingAccountHash, []byte(creds.Password))
+		return storage.DefaultUser, ErrWrongCredentials{}
+	default:
+		return storage.DefaultUser, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(creds.Password)); err != nil {
+		return storage.DefaultUser, ErrWrongCredentials{}
+	}
+
+	// urls of anonymous user are kept by account, users with account are never bound
+	if user, err := storage.GetUser(ctx); err == nil {
+		if err := u.stor.BindUser(ctx, user, account.User); err != nil {
+			return storage.DefaultUser, err
+		}
+	}
+
+	return account.User, nil
+}
+
+// parseCredentials returns normalized login
+func parseCredentials(creds Credentials) (string, error) {
+	login := strings.ToLower(strings.TrimSpace(creds.Login))
+	if !loginPattern.MatchString(login) {
+		return "", ErrInvalidCredentials{}
+	}
+
+	if len(creds.Password) < minPasswordLength || len(creds.Password) > maxPasswordLength {
+		return "", ErrInvalidCredentials{}
+	}
+
+	return login, nil
+}
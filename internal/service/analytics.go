@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+const (
+	analyticsQueueSize     = 10000
+	analyticsBatchSize     = 500
+	analyticsFlushInterval = time.Second
+	analyticsPurgeInterval = time.Hour
+	// DefaultAnalyticsRetention is how long click events are kept by default
+	DefaultAnalyticsRetention = 90 * 24 * time.Hour
+)
+
+// Visit describes redirect's client for analytics
+type Visit struct {
+	Referrer   string
+	UserAgent  string
+	RemoteAddr string
+}
+
+// analyticsQueue writes click events in batches, events are dropped when the queue is full
+type analyticsQueue struct {
+	events    chan storage.ClickEvent
+	stor      storage.Storage
+	retention time.Duration
+	dropped   uint64
+	stop      <-chan struct{}
+}
+
+func newAnalyticsQueue(stor storage.Storage, retention time.Duration, stop <-chan struct{}, workers *sync.WaitGroup) *analyticsQueue {
+	q := analyticsQueue{
+		events:    make(chan storage.ClickEvent, analyticsQueueSize),
+		stor:      stor,
+		retention: retention,
+		stop:      stop,
+	}
+
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		q.backgroundWrite()
+	}()
+	go func() {
+		defer workers.Done()
+		q.backgroundPurge()
+	}()
+
+	return &q
+}
+
+func (q *analyticsQueue) push(sid storage.ShortID, visit Visit, now time.Time) {
+	ev := storage.ClickEvent{
+		Sid:       sid,
+		Time:      now,
+		Referrer:  visit.Referrer,
+		UserAgent: visit.UserAgent,
+		IP:        anonymizeIP(visit.RemoteAddr),
+	}
+
+	select {
+	case q.events <- ev:
+	default:
+		if dropped := atomic.AddUint64(&q.dropped, 1); dropped%analyticsQueueSize == 1 {
+			log.Println("service: analytics: queue is full, dropped events:", dropped)
+		}
+	}
+}
+
+func (q *analyticsQueue) backgroundWrite() {
+	ticker := time.NewTicker(analyticsFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]storage.ClickEvent, 0, analyticsBatchSize)
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := q.stor.SaveClickEvents(context.Background(), batch); err != nil {
+			log.Println("service: analytics: cannot save click events:", err.Error())
+		}
+		batch = make([]storage.ClickEvent, 0, analyticsBatchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case ev := <-q.events:
+				batch = append(batch, ev)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case ev := <-q.events:
+			batch = append(batch, ev)
+			if len(batch) >= analyticsBatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-q.stop:
+			drain()
+			write()
+			return
+		}
+	}
+}
+
+func (q *analyticsQueue) backgroundPurge() {
+	ticker := time.NewTicker(analyticsPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-q.stop:
+			return
+		}
+
+		if len(q.stor.PendingMigrations(context.Background())) > 0 {
+			continue
+		}
+
+		purged, err := q.stor.PurgeClickEvents(context.Background(), now.Add(-q.retention))
+		if err != nil {
+			log.Println("service: analytics: cannot purge click events:", err.Error())
+			continue
+		}
+		if purged > 0 {
+			log.Println("service: analytics: purged click events:", purged)
+		}
+	}
+}
+
+// anonymizeIP keeps only network part of client address: /24 for IPv4 and /48 for IPv6
+func anonymizeIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+// apiKeyPrefix marks tokens of api keys, e.g. for secret scanners
+const apiKeyPrefix = "usk_"
+
+const maxAPIKeyNameLength = 100
+
+var apiKeyScopes = map[string]struct{}{ScopeRead: {}, ScopeWrite: {}, ScopeDelete: {}}
+
+func (u *URLShortener) CreateAPIKey(ctx context.Context, req APIKeyRequest) (APIKey, error) {
+	scopes, err := parseScopes(req.Scopes)
+	if err != nil || len(req.Name) > maxAPIKeyNameLength {
+		return APIKey{}, ErrInvalidScopes{}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, err
+	}
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := storage.APIKey{Name: req.Name, Hash: hashAPIKey(token), Scopes: scopes, CreatedAt: time.Now()}
+	id, err := u.stor.SaveAPIKey(ctx, key)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return APIKey{ID: string(id), Name: key.Name, Scopes: key.Scopes, CreatedAt: key.CreatedAt, Key: token}, nil
+}
+
+func (u *URLShortener) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	keys, err := u.stor.GetAPIKeys(ctx)
+	if err != nil {
+		return []APIKey{}, err
+	}
+
+	answer := []APIKey{}
+	for _, key := range keys {
+		answer = append(answer, APIKey{ID: string(key.ID), Name: key.Name, Scopes: key.Scopes, CreatedAt: key.CreatedAt})
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) RevokeAPIKey(ctx context.Context, id string) error {
+	return u.stor.RevokeAPIKey(ctx, storage.APIKeyID(id))
+}
+
+func (u *URLShortener) Authenticate(ctx context.Context, token string) (storage.User, []string, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return storage.DefaultUser, nil, ErrInvalidAPIKey{}
+	}
+
+	key, err := u.stor.GetAPIKey(ctx, hashAPIKey(token))
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		return storage.DefaultUser, nil, ErrInvalidAPIKey{}
+	default:
+		return storage.DefaultUser, nil, err
+	}
+
+	return key.User, key.Scopes, nil
+}
+
+// hashAPIKey does not need salt or slow hash, because tokens are long and random
+func hashAPIKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseScopes returns unique known scopes ordered by name, at least one is required
+func parseScopes(scopes []string) ([]string, error) {
+	unique := map[string]struct{}{}
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if _, known := apiKeyScopes[scope]; !known {
+			return nil, ErrInvalidScopes{}
+		}
+		unique[scope] = struct{}{}
+	}
+	if len(unique) == 0 {
+		return nil, ErrInvalidScopes{}
+	}
+
+	result := []string{}
+	for scope := range unique {
+		result = append(result, scope)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
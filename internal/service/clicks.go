@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+const (
+	clicksFlushInterval = 5 * time.Second
+	// flush earlier if that many urls got clicked
+	maxBufferedClicks = 1000
+)
+
+type clicksKey struct {
+	sid storage.ShortID
+	day time.Time
+}
+
+// clickBuffer aggregates redirects in memory, so redirects never wait for storage
+type clickBuffer struct {
+	mutex  sync.Mutex
+	clicks map[clicksKey]*storage.Clicks
+	// saving is held exclusively while taken clicks are written, so readers never see them twice or not at all
+	saving sync.RWMutex
+	stor   storage.Storage
+	full   chan struct{}
+	stop   <-chan struct{}
+}
+
+func newClickBuffer(stor storage.Storage, stop <-chan struct{}, workers *sync.WaitGroup) *clickBuffer {
+	b := clickBuffer{clicks: map[clicksKey]*storage.Clicks{}, stor: stor, full: make(chan struct{}, 1), stop: stop}
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		b.backgroundFlush()
+	}()
+
+	return &b
+}
+
+func (b *clickBuffer) add(sid storage.ShortID, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	key := clicksKey{sid: sid, day: storage.ClickDay(now)}
+	clicks, exist := b.clicks[key]
+	if !exist {
+		clicks = &storage.Clicks{Sid: sid, Day: key.day, First: now}
+		b.clicks[key] = clicks
+	}
+	clicks.Count += 1
+	clicks.Last = now
+
+	if len(b.clicks) >= maxBufferedClicks {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *clickBuffer) flush(ctx context.Context) error {
+	b.saving.Lock()
+	defer b.saving.Unlock()
+
+	b.mutex.Lock()
+	buffered := b.clicks
+	b.clicks = map[clicksKey]*storage.Clicks{}
+	b.mutex.Unlock()
+
+	if len(buffered) == 0 {
+		return nil
+	}
+
+	clicks := make([]storage.Clicks, 0, len(buffered))
+	for _, c := range buffered {
+		clicks = append(clicks, *c)
+	}
+
+	if err := b.stor.SaveClicks(ctx, clicks); err != nil {
+		b.restore(buffered)
+		return err
+	}
+
+	return nil
+}
+
+// restore returns not saved clicks back to buffer
+func (b *clickBuffer) restore(buffered map[clicksKey]*storage.Clicks) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for key, c := range buffered {
+		clicks, exist := b.clicks[key]
+		if !exist {
+			b.clicks[key] = c
+			continue
+		}
+		clicks.Count += c.Count
+		if c.First.Before(clicks.First) {
+			clicks.First = c.First
+		}
+		if c.Last.After(clicks.Last) {
+			clicks.Last = c.Last
+		}
+	}
+}
+
+// stats returns stored stats of url with not flushed yet clicks on top
+func (b *clickBuffer) stats(ctx context.Context, sid storage.ShortID) (storage.URLStats, error) {
+	b.saving.RLock()
+	defer b.saving.RUnlock()
+
+	stats, err := b.stor.GetStats(ctx, sid)
+	if err != nil {
+		return storage.URLStats{}, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for key, c := range b.clicks {
+		if key.sid == sid {
+			stats.Add(*c)
+		}
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Day.Before(stats.Daily[j].Day)
+	})
+
+	return stats, nil
+}
+
+func (b *clickBuffer) backgroundFlush() {
+	ticker := time.NewTicker(clicksFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		case <-b.stop:
+			return
+		}
+
+		if err := b.flush(context.Background()); err != nil {
+			log.Println("service: clicks: cannot flush clicks:", err.Error())
+		}
+	}
+}
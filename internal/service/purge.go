@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
+)
+
+const purgeInterval = time.Hour
+
+// DefaultPurgeAfter is how long deleted urls are kept before purge by default
+const DefaultPurgeAfter = 30 * 24 * time.Hour
+
+// WithPurge sets how long deleted urls are kept before purge, zero disables periodic purge.
+// Purged ShortIDs are either freed for new urls or kept blocked
+func WithPurge(after time.Duration, keepBlocked bool) Option {
+	return func(u *URLShortener) {
+		u.purgeAfter = after
+		settings := u.Settings()
+		settings.KeepBlocked = keepBlocked
+		u.current.Store(settings)
+	}
+}
+
+func (u *URLShortener) PurgeDeleted(ctx context.Context) (storage.PurgeStats, error) {
+	settings := u.Settings()
+
+	// never purge urls which still may be restored
+	keep := u.purgeAfter
+	if keep < settings.RestoreWindow {
+		keep = settings.RestoreWindow
+	}
+
+	return u.stor.PurgeDeleted(ctx, time.Now().Add(-keep), settings.KeepBlocked)
+}
+
+func (u *URLShortener) backgroundPurge() {
+	defer u.workers.Done()
+
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-u.stop:
+			return
+		}
+
+		if len(u.stor.PendingMigrations(context.Background())) > 0 {
+			continue
+		}
+
+		stats, err := u.PurgeDeleted(context.Background())
+		if err != nil {
+			log.Println("service: purge: cannot purge deleted urls:", err.Error())
+			continue
+		}
+		if stats.URLs > 0 || stats.Relations > 0 {
+			log.Println("service: purge: purged urls:", stats.URLs, "relations:", stats.Relations)
+		}
+	}
+}
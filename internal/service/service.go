@@ -2,6 +2,13 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
 )
@@ -12,14 +19,223 @@ func (e ErrInvalidURL) Error() string {
 	return "Repository: invalid URL"
 }
 
+type ErrInvalidAlias struct{}
+
+func (e ErrInvalidAlias) Error() string {
+	return "Repository: invalid alias"
+}
+
+type ErrInvalidExpiration struct{}
+
+func (e ErrInvalidExpiration) Error() string {
+	return "Repository: invalid expiration"
+}
+
+type ErrInvalidDetails struct{}
+
+func (e ErrInvalidDetails) Error() string {
+	return "Repository: invalid title or note"
+}
+
+type ErrInvalidTags struct{}
+
+func (e ErrInvalidTags) Error() string {
+	return "Repository: invalid tags"
+}
+
+type ErrInvalidURLsQuery struct{}
+
+func (e ErrInvalidURLsQuery) Error() string {
+	return "Repository: invalid urls query"
+}
+
+type ErrInvalidAPIKey struct{}
+
+func (e ErrInvalidAPIKey) Error() string {
+	return "Repository: invalid api key"
+}
+
+type ErrInvalidScopes struct{}
+
+func (e ErrInvalidScopes) Error() string {
+	return "Repository: invalid api key name or scopes"
+}
+
+type ErrInvalidCredentials struct{}
+
+func (e ErrInvalidCredentials) Error() string {
+	return "Repository: invalid login or password"
+}
+
+type ErrWrongCredentials struct{}
+
+func (e ErrWrongCredentials) Error() string {
+	return "Repository: wrong login or password"
+}
+
+type ErrInvalidAnalyticsQuery struct{}
+
+func (e ErrInvalidAnalyticsQuery) Error() string {
+	return "Repository: invalid analytics query"
+}
+
+// URLs is shorted url of user, Own tells whether user created it or it is just shared with them
 type URLs struct {
-	Short    string `json:"short_url"`
-	Original string `json:"original_url"`
+	Short     string     `json:"short_url"`
+	Original  string     `json:"original_url"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	Own       bool       `json:"own,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Details
+}
+
+// URLsRequest selects a page of user's urls. Sort is "created" or "clicks",
+// prefixed by "-" for descending order, Cursor is taken from previous page.
+// Clicks are flushed in background, so urls are ordered by them with a lag
+type URLsRequest struct {
+	Limit    int
+	Cursor   string
+	Sort     string
+	Contains string
+	Tag      string
+}
+
+type URLsPage struct {
+	URLs []URLs
+	// Next is cursor of the next page, empty for the last one
+	Next string
+}
+
+// Expiration limits link lifetime either by absolute time or by ttl in seconds
+type Expiration struct {
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
+}
+
+// Details are optional free-form texts about link
+type Details struct {
+	Title string `json:"title,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+type ShortenRequest struct {
+	URL   string   `json:"url"`
+	Alias string   `json:"alias,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Expiration
+	Details
+}
+
+type DailyStats struct {
+	Day    string `json:"day"`
+	Clicks int64  `json:"clicks"`
+}
+
+type Stats struct {
+	Short      string       `json:"short_url"`
+	Clicks     int64        `json:"clicks"`
+	FirstClick *time.Time   `json:"first_click,omitempty"`
+	LastClick  *time.Time   `json:"last_click,omitempty"`
+	Daily      []DailyStats `json:"daily"`
+}
+
+type AnalyticsGroup struct {
+	Key      string `json:"key"`
+	Clicks   int64  `json:"clicks"`
+	Visitors int64  `json:"visitors"`
+}
+
+type Analytics struct {
+	Short   string           `json:"short_url"`
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	GroupBy string           `json:"group_by"`
+	Groups  []AnalyticsGroup `json:"groups"`
+}
+
+type DeletedURLs struct {
+	Short           string    `json:"short_url"`
+	Original        string    `json:"original_url"`
+	DeletedAt       time.Time `json:"deleted_at"`
+	RestorableUntil time.Time `json:"restorable_until"`
+}
+
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+)
+
+// DeleteJob reports deletion of user's urls, urls are split into deleted and skipped ones when job is done
+type DeleteJob struct {
+	ID        string     `json:"job_id"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	DoneAt    *time.Time `json:"done_at,omitempty"`
+	Requested []string   `json:"requested"`
+	Deleted   []string   `json:"deleted"`
+	Skipped   []string   `json:"skipped"`
+}
+
+type UpdateRequest struct {
+	URL string `json:"url"`
+}
+
+type HistoryItem struct {
+	User      storage.User `json:"user"`
+	ChangedAt time.Time    `json:"changed_at"`
+	OldURL    string       `json:"old_url"`
+	NewURL    string       `json:"new_url"`
 }
 
 type BatchRequestItem struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string   `json:"correlation_id"`
+	OriginalURL   string   `json:"original_url"`
+	Tags          []string `json:"tags,omitempty"`
+	Expiration
+	Details
+}
+
+type TagItem struct {
+	Tag  string `json:"tag"`
+	URLs int64  `json:"urls"`
+}
+
+// scopes of api keys, users authenticated by cookie have them all
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopeDelete = "delete"
+)
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// APIKey is user's api key, Key is token, which is shown on creation only
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	Key       string    `json:"key,omitempty"`
+}
+
+type Credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+type Account struct {
+	Login     string    `json:"login"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Readiness tells whether service may serve requests
+type Readiness struct {
+	Ready   bool     `json:"ready"`
+	Pending []string `json:"pending_migrations,omitempty"`
 }
 
 type BatchResponseItem struct {
@@ -29,14 +245,290 @@ type BatchResponseItem struct {
 
 type Repository interface {
 	SaveURL(ctx context.Context, fullURL string) (string, error)
+	Shorten(ctx context.Context, req ShortenRequest) (string, error)
 	SaveBatch(ctx context.Context, breq []BatchRequestItem) ([]BatchResponseItem, error)
-	GetURL(ctx context.Context, shortIDstr string) (string, error)
-	GetURLs(ctx context.Context) ([]URLs, error)
-	DeleteURLs(ctx context.Context, todelete []string) error
+	GetURL(ctx context.Context, shortIDstr string, visit Visit) (string, error)
+	GetURLs(ctx context.Context, req URLsRequest) (URLsPage, error)
+	UpdateURL(ctx context.Context, shortIDstr string, req UpdateRequest) (URLs, error)
+	GetHistory(ctx context.Context, shortIDstr string) ([]HistoryItem, error)
+	SetTags(ctx context.Context, shortIDstr string, tags []string) ([]string, error)
+	GetTags(ctx context.Context) ([]TagItem, error)
+	GetStats(ctx context.Context, shortIDstr string) (Stats, error)
+	GetAnalytics(ctx context.Context, shortIDstr, from, to, groupBy string) (Analytics, error)
+	DeleteURLs(ctx context.Context, todelete []string) (string, error)
+	GetDeleteJob(ctx context.Context, id string) (DeleteJob, error)
+	GetDeletedURLs(ctx context.Context) ([]DeletedURLs, error)
+	RestoreURLs(ctx context.Context, torestore []string) ([]URLs, error)
+	PurgeDeleted(ctx context.Context) (storage.PurgeStats, error)
+	CreateAPIKey(ctx context.Context, req APIKeyRequest) (APIKey, error)
+	GetAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string) error
+	// Authenticate returns user and scopes of api key token
+	Authenticate(ctx context.Context, token string) (storage.User, []string, error)
+	// Register creates account of current user
+	Register(ctx context.Context, creds Credentials) (Account, error)
+	// Login returns user of account and binds urls of current anonymous user to it
+	Login(ctx context.Context, creds Credentials) (storage.User, error)
 	NewUser(ctx context.Context) (storage.User, error)
 	Ping(ctx context.Context) bool
+	// PendingMigrations lists storage migrations, which are not applied yet, storage is not used until they are
+	PendingMigrations(ctx context.Context) []string
+	Readiness(ctx context.Context) Readiness
+	Settings() Settings
+	Reload(settings Settings)
+	// Close flushes buffered clicks and closes storage
+	Close(ctx context.Context) error
+}
+
+const minAliasLength = 3
+
+const (
+	maxTagLength   = 32
+	maxURLTags     = 20
+	maxTitleLength = 256
+	maxNoteLength  = 4096
+)
+
+const (
+	defaultURLsLimit = 100
+	maxURLsLimit     = 1000
+	defaultURLsSort  = "-created"
+)
+
+// DefaultRestoreWindow is how long deleted urls may be restored by default
+const DefaultRestoreWindow = 7 * 24 * time.Hour
+
+const dayLayout = "2006-01-02"
+
+// defaultAnalyticsPeriod is used when analytics query has no "from"
+const defaultAnalyticsPeriod = 30 * 24 * time.Hour
+
+// aliases which may clash with current or future routes
+var reservedAliases = map[string]struct{}{
+	"api":     {},
+	"ping":    {},
+	"healthz": {},
+	"readyz":  {},
+	"admin":   {},
+	"static":  {},
 }
 
 func isValidURL(url string) bool {
 	return url != ""
 }
+
+// parseAlias accepts aliases written in canonical form of codec and shorter than any generated ShortID
+func parseAlias(codec storage.Codec, alias string) (storage.ShortID, error) {
+	if len(alias) < minAliasLength || len(alias) >= codec.MaxLen() {
+		return storage.DefaultShortID, ErrInvalidAlias{}
+	}
+
+	if _, reserved := reservedAliases[strings.ToLower(alias)]; reserved {
+		return storage.DefaultShortID, ErrInvalidAlias{}
+	}
+
+	sid, err := codec.Decode(alias)
+	if err != nil || codec.Encode(sid) != alias {
+		return storage.DefaultShortID, ErrInvalidAlias{}
+	}
+
+	return sid, nil
+}
+
+// parseTags lowercases tags and returns them sorted without duplicates,
+// tag consists of letters, digits, "-" and "_" and starts with letter or digit
+func parseTags(tags []string) ([]string, error) {
+	unique := map[string]struct{}{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !isValidTag(tag) {
+			return nil, ErrInvalidTags{}
+		}
+		unique[tag] = struct{}{}
+	}
+
+	if len(unique) > maxURLTags {
+		return nil, ErrInvalidTags{}
+	}
+
+	result := make([]string, 0, len(unique))
+	for tag := range unique {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+func isValidTag(tag string) bool {
+	if tag == "" || len(tag) > maxTagLength {
+		return false
+	}
+
+	for i, r := range tag {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r):
+		case i > 0 && (r == '-' || r == '_'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseURLsQuery(req URLsRequest) (storage.URLsQuery, error) {
+	query := storage.URLsQuery{Contains: req.Contains, Limit: req.Limit}
+
+	if req.Tag != "" {
+		tags, err := parseTags([]string{req.Tag})
+		if err != nil {
+			return query, ErrInvalidURLsQuery{}
+		}
+		query.Tag = tags[0]
+	}
+
+	switch {
+	case req.Limit == 0:
+		query.Limit = defaultURLsLimit
+	case req.Limit < 0 || req.Limit > maxURLsLimit:
+		return query, ErrInvalidURLsQuery{}
+	}
+
+	sortBy := req.Sort
+	if sortBy == "" {
+		sortBy = defaultURLsSort
+	}
+	if strings.HasPrefix(sortBy, "-") {
+		query.Desc = true
+		sortBy = strings.TrimPrefix(sortBy, "-")
+	}
+	query.Sort = storage.URLsSort(sortBy)
+	switch query.Sort {
+	case storage.SortByCreated, storage.SortByClicks:
+	default:
+		return query, ErrInvalidURLsQuery{}
+	}
+
+	if req.Cursor != "" {
+		cursor, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return query, ErrInvalidURLsQuery{}
+		}
+		query.After = &cursor
+	}
+
+	return query, nil
+}
+
+func encodeCursor(cursor storage.URLsCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", cursor.Value, cursor.Sid)))
+}
+
+func decodeCursor(str string) (storage.URLsCursor, error) {
+	cursor := storage.URLsCursor{}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return cursor, err
+	}
+
+	value, sid, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return cursor, ErrInvalidURLsQuery{}
+	}
+	if cursor.Value, err = strconv.ParseInt(value, 10, 64); err != nil {
+		return cursor, err
+	}
+	parsedSid, err := strconv.ParseInt(sid, 10, 64)
+	cursor.Sid = storage.ShortID(parsedSid)
+
+	return cursor, err
+}
+
+func (e Expiration) meta(now time.Time) (storage.URLMeta, error) {
+	meta := storage.URLMeta{}
+
+	switch {
+	case e.ExpiresAt != nil && e.TTL != 0:
+		return meta, ErrInvalidExpiration{}
+	case e.TTL < 0:
+		return meta, ErrInvalidExpiration{}
+	case e.TTL > 0:
+		meta.ExpiresAt = now.Add(time.Duration(e.TTL) * time.Second)
+	case e.ExpiresAt != nil:
+		if !e.ExpiresAt.After(now) {
+			return meta, ErrInvalidExpiration{}
+		}
+		meta.ExpiresAt = *e.ExpiresAt
+	}
+
+	return meta, nil
+}
+
+// newURLMeta collects everything saved along with url created by user from ctx
+func newURLMeta(ctx context.Context, now time.Time, e Expiration, d Details) (storage.URLMeta, error) {
+	meta, err := e.meta(now)
+	if err != nil {
+		return meta, err
+	}
+
+	if len(d.Title) > maxTitleLength || len(d.Note) > maxNoteLength {
+		return meta, ErrInvalidDetails{}
+	}
+
+	meta.CreatedAt = now
+	meta.Creator, _ = storage.GetUser(ctx)
+	meta.Title = d.Title
+	meta.Note = d.Note
+
+	return meta, nil
+}
+
+// parseAnalyticsQuery accepts RFC3339 times or days, day as "to" includes the whole day
+func parseAnalyticsQuery(sid storage.ShortID, from, to, groupBy string, now time.Time) (storage.AnalyticsQuery, error) {
+	query := storage.AnalyticsQuery{Sid: sid, To: now, GroupBy: storage.GroupByDay}
+
+	switch storage.AnalyticsGroup(groupBy) {
+	case "":
+	case storage.GroupByDay, storage.GroupByReferrer, storage.GroupByAgent:
+		query.GroupBy = storage.AnalyticsGroup(groupBy)
+	default:
+		return query, ErrInvalidAnalyticsQuery{}
+	}
+
+	if to != "" {
+		t, isDay, err := parseTime(to)
+		if err != nil {
+			return query, ErrInvalidAnalyticsQuery{}
+		}
+		if isDay {
+			t = t.Add(24 * time.Hour)
+		}
+		query.To = t
+	}
+
+	query.From = query.To.Add(-defaultAnalyticsPeriod)
+	if from != "" {
+		t, _, err := parseTime(from)
+		if err != nil {
+			return query, ErrInvalidAnalyticsQuery{}
+		}
+		query.From = t
+	}
+
+	if !query.From.Before(query.To) {
+		return query, ErrInvalidAnalyticsQuery{}
+	}
+
+	return query, nil
+}
+
+func parseTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(dayLayout, value); err == nil {
+		return t, true, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
@@ -0,0 +1,20 @@
+package service
+
+import "time"
+
+// Settings are parameters of URLShortener, which are changed without restart by Reload
+type Settings struct {
+	BaseURL       string
+	RestoreWindow time.Duration
+	KeepBlocked   bool
+}
+
+// Settings returns current settings
+func (u *URLShortener) Settings() Settings {
+	return u.current.Load().(Settings)
+}
+
+// Reload swaps settings at once, requests in progress finish with previous ones
+func (u *URLShortener) Reload(settings Settings) {
+	u.current.Store(settings)
+}
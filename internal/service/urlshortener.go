@@ -3,52 +3,160 @@ package service
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
 )
 
 type URLShortener struct {
-	stor    storage.Storage
-	baseURL string
+	stor      storage.Storage
+	codec     storage.Codec
+	clicks    *clickBuffer
+	analytics *analyticsQueue
+	retention time.Duration
+	// purge of deleted urls
+	purgeAfter time.Duration
+	// current holds reloadable Settings
+	current atomic.Value
+	// stop is closed on Close, workers counts background loops, so Close waits for them before storage is closed
+	stop    chan struct{}
+	workers sync.WaitGroup
+	once    sync.Once
 }
 
-func NewURLShortener(s storage.Storage, baseURL string) Repository {
-	return &URLShortener{s, baseURL}
+type Option func(u *URLShortener)
+
+func WithCodec(codec storage.Codec) Option {
+	return func(u *URLShortener) {
+		u.codec = codec
+	}
+}
+
+// WithAnalyticsRetention sets how long click events are kept
+func WithAnalyticsRetention(retention time.Duration) Option {
+	return func(u *URLShortener) {
+		u.retention = retention
+	}
+}
+
+// WithRestoreWindow sets how long deleted urls may be restored
+func WithRestoreWindow(window time.Duration) Option {
+	return func(u *URLShortener) {
+		settings := u.Settings()
+		settings.RestoreWindow = window
+		u.current.Store(settings)
+	}
+}
+
+func NewURLShortener(s storage.Storage, baseURL string, opts ...Option) Repository {
+	u := &URLShortener{stor: s, codec: storage.DefaultCodec, retention: DefaultAnalyticsRetention, purgeAfter: DefaultPurgeAfter, stop: make(chan struct{})}
+	u.current.Store(Settings{BaseURL: baseURL, RestoreWindow: DefaultRestoreWindow, KeepBlocked: true})
+	for _, opt := range opts {
+		opt(u)
+	}
+	u.clicks = newClickBuffer(s, u.stop, &u.workers)
+	u.analytics = newAnalyticsQueue(s, u.retention, u.stop, &u.workers)
+	if u.purgeAfter > 0 {
+		u.workers.Add(1)
+		go u.backgroundPurge()
+	}
+
+	return u
 }
 
 func (u *URLShortener) getShortURL(sid storage.ShortID) string {
-	return fmt.Sprintf("%s/%v", u.baseURL, sid)
+	return fmt.Sprintf("%s/%s", u.Settings().BaseURL, u.codec.Encode(sid))
 }
 
 func (u *URLShortener) getFullURL(furl storage.FullURL) string {
 	return fmt.Sprint(furl)
 }
 
+func (u *URLShortener) getURLs(user storage.User, url storage.UserURL) URLs {
+	urls := URLs{
+		Short:    u.getShortURL(url.Sid),
+		Original: u.getFullURL(url.URL),
+		Own:      url.Meta.Creator == user,
+		Tags:     url.Tags,
+		Details:  Details{Title: url.Meta.Title, Note: url.Meta.Note},
+	}
+	if !url.Meta.CreatedAt.IsZero() {
+		urls.CreatedAt = &url.Meta.CreatedAt
+	}
+	if !url.Meta.UpdatedAt.IsZero() {
+		urls.UpdatedAt = &url.Meta.UpdatedAt
+	}
+
+	return urls
+}
+
 func (u *URLShortener) getCorrelationID(corrid storage.CorrelationID) string {
 	return fmt.Sprint(corrid)
 }
 
 func (u *URLShortener) SaveURL(ctx context.Context, fullURL string) (string, error) {
-	if !isValidURL(fullURL) {
+	return u.Shorten(ctx, ShortenRequest{URL: fullURL})
+}
+
+func (u *URLShortener) Shorten(ctx context.Context, req ShortenRequest) (string, error) {
+	if !isValidURL(req.URL) {
 		return "", ErrInvalidURL{}
 	}
 
-	furl := storage.FullURL(fullURL)
+	furl := storage.FullURL(req.URL)
 
-	sid, err := u.stor.Put(ctx, furl)
+	meta, err := newURLMeta(ctx, time.Now(), req.Expiration, req.Details)
 	if err != nil {
-		return u.getShortURL(sid), err
+		return "", err
+	}
+
+	// tags are saved along with url
+	if meta.Tags, err = parseTags(req.Tags); err != nil {
+		return "", err
+	}
+
+	var sid storage.ShortID
+	if req.Alias != "" {
+		if sid, err = parseAlias(u.codec, req.Alias); err != nil {
+			return "", err
+		}
+		err = u.stor.Save(ctx, sid, furl, meta)
+	} else {
+		sid, err = u.stor.Put(ctx, furl, meta)
+	}
+	if _, conflict := err.(storage.ErrConflict); conflict && len(meta.Tags) > 0 {
+		// already shortened url of user gets requested tags, while
+		// url of another user can not be tagged as it is not user's one
+		if tagErr := u.stor.SetTags(ctx, sid, meta.Tags); tagErr != nil {
+			if _, notFound := tagErr.(storage.ErrNotFound); !notFound {
+				return u.getShortURL(sid), tagErr
+			}
+		}
 	}
 
-	return u.getShortURL(sid), nil
+	return u.getShortURL(sid), err
 }
 
 func (u *URLShortener) SaveBatch(ctx context.Context, breq []BatchRequestItem) ([]BatchResponseItem, error) {
+	now := time.Now()
+
 	storRequest := storage.BatchRequest{}
 	for _, v := range breq {
+		meta, err := newURLMeta(ctx, now, v.Expiration, v.Details)
+		if err != nil {
+			return nil, err
+		}
+
 		corrid := storage.ParseCorrelationID(v.CorrelationID)
+		if meta.Tags, err = parseTags(v.Tags); err != nil {
+			return nil, err
+		}
+
 		furl := storage.FullURL(v.OriginalURL)
-		storRequest[corrid] = furl
+		storRequest[corrid] = storage.BatchURL{URL: furl, Meta: meta}
 	}
 
 	storResponse, err := u.stor.PutBatch(ctx, storRequest)
@@ -59,8 +167,8 @@ func (u *URLShortener) SaveBatch(ctx context.Context, breq []BatchRequestItem) (
 	return result, err
 }
 
-func (u *URLShortener) GetURL(ctx context.Context, shortIDstr string) (string, error) {
-	sid, err := storage.ParseShort(shortIDstr)
+func (u *URLShortener) GetURL(ctx context.Context, shortIDstr string, visit Visit) (string, error) {
+	sid, err := storage.ParseShort(u.codec, shortIDstr)
 	if err != nil {
 		return "", err
 	}
@@ -69,34 +177,245 @@ func (u *URLShortener) GetURL(ctx context.Context, shortIDstr string) (string, e
 	if err != nil {
 		return "", err
 	}
+
+	now := time.Now()
+	u.clicks.add(sid, now)
+	u.analytics.push(sid, visit, now)
+
 	return u.getFullURL(furl), nil
 }
 
-func (u *URLShortener) GetURLs(ctx context.Context) ([]URLs, error) {
-	urls, err := u.stor.GetURLs(ctx)
+func (u *URLShortener) GetURLs(ctx context.Context, req URLsRequest) (URLsPage, error) {
+	query, err := parseURLsQuery(req)
 	if err != nil {
-		return []URLs{}, err
+		return URLsPage{}, err
 	}
 
-	answer := []URLs{}
-	for sid, furl := range urls {
-		answer = append(answer, URLs{Short: u.getShortURL(sid), Original: u.getFullURL(furl)})
+	// one more url tells whether the next page exists
+	limit := query.Limit
+	query.Limit++
+
+	urls, err := u.stor.GetURLs(ctx, query)
+	if err != nil {
+		return URLsPage{}, err
+	}
+
+	// storage has already checked user
+	user, _ := storage.GetUser(ctx)
+
+	answer := URLsPage{URLs: []URLs{}}
+	if len(urls) > limit {
+		urls = urls[:limit]
+		answer.Next = encodeCursor(urls[limit-1].Cursor(query.Sort))
+	}
+	for _, url := range urls {
+		answer.URLs = append(answer.URLs, u.getURLs(user, url))
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) UpdateURL(ctx context.Context, shortIDstr string, req UpdateRequest) (URLs, error) {
+	sid, err := storage.ParseShort(u.codec, shortIDstr)
+	if err != nil {
+		return URLs{}, err
+	}
+
+	if !isValidURL(req.URL) {
+		return URLs{}, ErrInvalidURL{}
+	}
+
+	if err := u.stor.UpdateURL(ctx, sid, storage.FullURL(req.URL)); err != nil {
+		return URLs{}, err
+	}
+
+	return URLs{Short: u.getShortURL(sid), Original: req.URL}, nil
+}
+
+func (u *URLShortener) GetHistory(ctx context.Context, shortIDstr string) ([]HistoryItem, error) {
+	sid, err := storage.ParseShort(u.codec, shortIDstr)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := u.stor.GetHistory(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := []HistoryItem{}
+	for _, entry := range history {
+		answer = append(answer, HistoryItem{User: entry.User, ChangedAt: entry.ChangedAt, OldURL: string(entry.OldURL), NewURL: string(entry.NewURL)})
 	}
 
 	return answer, nil
 }
 
-func (u *URLShortener) DeleteURLs(ctx context.Context, todelete []string) error {
+func (u *URLShortener) SetTags(ctx context.Context, shortIDstr string, tags []string) ([]string, error) {
+	sid, err := storage.ParseShort(u.codec, shortIDstr)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err = parseTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, u.stor.SetTags(ctx, sid, tags)
+}
+
+func (u *URLShortener) GetTags(ctx context.Context) ([]TagItem, error) {
+	tags, err := u.stor.GetTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	answer := []TagItem{}
+	for _, tc := range tags {
+		answer = append(answer, TagItem{Tag: tc.Tag, URLs: tc.URLs})
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) GetStats(ctx context.Context, shortIDstr string) (Stats, error) {
+	sid, err := storage.ParseShort(u.codec, shortIDstr)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	// show redirects which are not flushed yet
+	stats, err := u.clicks.stats(ctx, sid)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	answer := Stats{Short: u.getShortURL(sid), Clicks: stats.Clicks, Daily: []DailyStats{}}
+	if !stats.FirstClick.IsZero() {
+		answer.FirstClick = &stats.FirstClick
+	}
+	if !stats.LastClick.IsZero() {
+		answer.LastClick = &stats.LastClick
+	}
+	for _, daily := range stats.Daily {
+		answer.Daily = append(answer.Daily, DailyStats{Day: daily.Day.Format(dayLayout), Clicks: daily.Count})
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) GetAnalytics(ctx context.Context, shortIDstr, from, to, groupBy string) (Analytics, error) {
+	sid, err := storage.ParseShort(u.codec, shortIDstr)
+	if err != nil {
+		return Analytics{}, err
+	}
+
+	query, err := parseAnalyticsQuery(sid, from, to, groupBy, time.Now())
+	if err != nil {
+		return Analytics{}, err
+	}
+
+	buckets, err := u.stor.GetAnalytics(ctx, query)
+	if err != nil {
+		return Analytics{}, err
+	}
+
+	answer := Analytics{Short: u.getShortURL(sid), From: query.From, To: query.To, GroupBy: string(query.GroupBy), Groups: []AnalyticsGroup{}}
+	for _, bucket := range buckets {
+		answer.Groups = append(answer.Groups, AnalyticsGroup{Key: bucket.Key, Clicks: bucket.Clicks, Visitors: bucket.Visitors})
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) DeleteURLs(ctx context.Context, todelete []string) (string, error) {
 	sids := []storage.ShortID{}
 	for _, shortIDstr := range todelete {
-		sid, err := storage.ParseShort(shortIDstr)
+		sid, err := storage.ParseShort(u.codec, shortIDstr)
+		if err != nil {
+			return "", err
+		}
+		sids = append(sids, sid)
+	}
+
+	id, err := u.stor.DeleteURLs(ctx, sids)
+
+	return string(id), err
+}
+
+func (u *URLShortener) GetDeleteJob(ctx context.Context, id string) (DeleteJob, error) {
+	job, err := u.stor.GetDeleteJob(ctx, storage.JobID(id))
+	if err != nil {
+		return DeleteJob{}, err
+	}
+
+	answer := DeleteJob{
+		ID:        string(job.ID),
+		Status:    JobPending,
+		CreatedAt: job.CreatedAt,
+		Requested: u.getShortIDs(job.Requested),
+		Deleted:   u.getShortIDs(job.Deleted),
+		Skipped:   u.getShortIDs(job.Skipped),
+	}
+	if job.Done() {
+		answer.Status = JobDone
+		answer.DoneAt = &job.DoneAt
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) getShortIDs(sids []storage.ShortID) []string {
+	result := []string{}
+	for _, sid := range sids {
+		result = append(result, u.codec.Encode(sid))
+	}
+
+	return result
+}
+
+func (u *URLShortener) GetDeletedURLs(ctx context.Context) ([]DeletedURLs, error) {
+	restore := u.Settings().RestoreWindow
+	deleted, err := u.stor.GetDeletedURLs(ctx, time.Now().Add(-restore))
+	if err != nil {
+		return []DeletedURLs{}, err
+	}
+
+	answer := []DeletedURLs{}
+	for _, d := range deleted {
+		answer = append(answer, DeletedURLs{
+			Short:           u.getShortURL(d.Sid),
+			Original:        u.getFullURL(d.URL),
+			DeletedAt:       d.DeletedAt,
+			RestorableUntil: d.DeletedAt.Add(restore),
+		})
+	}
+
+	return answer, nil
+}
+
+func (u *URLShortener) RestoreURLs(ctx context.Context, torestore []string) ([]URLs, error) {
+	sids := []storage.ShortID{}
+	for _, shortIDstr := range torestore {
+		sid, err := storage.ParseShort(u.codec, shortIDstr)
 		if err != nil {
-			return err
+			return []URLs{}, err
 		}
 		sids = append(sids, sid)
 	}
 
-	return u.stor.DeleteURLs(ctx, sids)
+	restored, err := u.stor.RestoreURLs(ctx, sids, time.Now().Add(-u.Settings().RestoreWindow))
+	if err != nil {
+		return []URLs{}, err
+	}
+
+	answer := []URLs{}
+	for sid, furl := range restored {
+		answer = append(answer, URLs{Short: u.getShortURL(sid), Original: u.getFullURL(furl)})
+	}
+
+	return answer, nil
 }
 
 func (u *URLShortener) NewUser(ctx context.Context) (storage.User, error) {
@@ -106,3 +425,38 @@ func (u *URLShortener) NewUser(ctx context.Context) (storage.User, error) {
 func (u *URLShortener) Ping(ctx context.Context) bool {
 	return u.stor.Ping(ctx)
 }
+
+func (u *URLShortener) PendingMigrations(ctx context.Context) []string {
+	return u.stor.PendingMigrations(ctx)
+}
+
+func (u *URLShortener) Readiness(ctx context.Context) Readiness {
+	pending := u.stor.PendingMigrations(ctx)
+
+	return Readiness{Ready: len(pending) == 0 && u.stor.Ping(ctx), Pending: pending}
+}
+
+// Close stops background workers, so none of them touches closed storage, then flushes clicks and closes storage.
+// Analytics writer saves queued click events on stop
+func (u *URLShortener) Close(ctx context.Context) error {
+	u.once.Do(func() {
+		close(u.stop)
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		u.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Println("service: Close: background workers are not stopped:", ctx.Err().Error())
+	}
+
+	if err := u.clicks.flush(ctx); err != nil {
+		log.Println("service: Close: cannot flush clicks:", err.Error())
+	}
+
+	return u.stor.Close(ctx)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// closingStorage counts writes of background workers after Close
+type closingStorage struct {
+	storage.Storage
+	mutex      sync.Mutex
+	closed     bool
+	events     int
+	afterClose int
+}
+
+func (s *closingStorage) write(events int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		s.afterClose++
+	}
+	s.events += events
+}
+
+func (s *closingStorage) SaveClicks(ctx context.Context, clicks []storage.Clicks) error {
+	s.write(0)
+	return s.Storage.SaveClicks(ctx, clicks)
+}
+
+func (s *closingStorage) SaveClickEvents(ctx context.Context, events []storage.ClickEvent) error {
+	s.write(len(events))
+	return s.Storage.SaveClickEvents(ctx, events)
+}
+
+func (s *closingStorage) Close(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+
+	return s.Storage.Close(ctx)
+}
+
+func TestURLShortener_Close(t *testing.T) {
+	stor := &closingStorage{Storage: storage.NewInMemory()}
+	u := NewURLShortener(stor, "http://localhost:8080").(*URLShortener)
+
+	now := time.Now()
+	u.clicks.add(storage.ShortID(1), now)
+	u.analytics.push(storage.ShortID(1), Visit{RemoteAddr: "127.0.0.1:1234"}, now)
+
+	assert.Nil(t, u.Close(context.Background()))
+
+	stopped := make(chan struct{})
+	go func() {
+		u.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		assert.Fail(t, "background workers are running after Close")
+	}
+
+	// queued click events are written before storage is closed and nothing is written after
+	stor.mutex.Lock()
+	defer stor.mutex.Unlock()
+	assert.Equal(t, 1, stor.events)
+	assert.Zero(t, stor.afterClose)
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	CodecBase62 = "base62"
+	CodecBase58 = "base58"
+	CodecBase32 = "base32"
+)
+
+type ErrUnknownCodec struct {
+	Name string
+}
+
+func (e ErrUnknownCodec) Error() string {
+	return fmt.Sprintf("Storage: unknown short id codec %q", e.Name)
+}
+
+// Codec converts ShortID to its url representation and back
+type Codec interface {
+	Encode(sid ShortID) string
+	Decode(str string) (ShortID, error)
+	// MaxLen is the length of the longest encoded ShortID
+	MaxLen() int
+}
+
+var (
+	Base62 Codec = newAlphabetCodec("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz", false, nil)
+	Base58 Codec = newAlphabetCodec("123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz", false, nil)
+	// https://www.crockford.com/base32.html
+	Base32 Codec = newAlphabetCodec("0123456789ABCDEFGHJKMNPQRSTVWXYZ", true, map[rune]rune{'O': '0', 'I': '1', 'L': '1'})
+)
+
+var DefaultCodec = Base62
+
+func NewCodec(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", CodecBase62:
+		return Base62, nil
+	case CodecBase58:
+		return Base58, nil
+	case CodecBase32:
+		return Base32, nil
+	}
+
+	return nil, ErrUnknownCodec{Name: name}
+}
+
+type alphabetCodec struct {
+	alphabet []byte
+	index    map[rune]uint64
+	maxLen   int
+}
+
+// aliases are additional symbols accepted on decode, e.g. 'O' for '0' in crockford base32
+func newAlphabetCodec(alphabet string, caseInsensitive bool, aliases map[rune]rune) *alphabetCodec {
+	c := alphabetCodec{alphabet: []byte(alphabet), index: map[rune]uint64{}}
+
+	for i, r := range alphabet {
+		c.index[r] = uint64(i)
+	}
+	for alias, r := range aliases {
+		c.index[alias] = c.index[r]
+	}
+	if caseInsensitive {
+		for r, digit := range c.index {
+			c.index[unicode.ToLower(r)] = digit
+		}
+	}
+
+	c.maxLen = len(c.Encode(ShortID(-1)))
+
+	return &c
+}
+
+func (c *alphabetCodec) Encode(sid ShortID) string {
+	// negative ids are legacy fnv hashes, so encode all 64 bits as unsigned
+	n := uint64(sid)
+	base := uint64(len(c.alphabet))
+
+	if n == 0 {
+		return string(c.alphabet[0])
+	}
+
+	encoded := make([]byte, 0, 16)
+	for n > 0 {
+		encoded = append(encoded, c.alphabet[n%base])
+		n /= base
+	}
+
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+
+	return string(encoded)
+}
+
+func (c *alphabetCodec) Decode(str string) (ShortID, error) {
+	if str == "" || len(str) > c.maxLen {
+		return DefaultShortID, ErrInvalidShortID{}
+	}
+
+	base := uint64(len(c.alphabet))
+
+	var n uint64
+	for _, r := range str {
+		digit, ok := c.index[r]
+		if !ok {
+			return DefaultShortID, ErrInvalidShortID{}
+		}
+
+		hi, lo := bits.Mul64(n, base)
+		lo, carry := bits.Add64(lo, digit, 0)
+		if hi != 0 || carry != 0 {
+			return DefaultShortID, ErrInvalidShortID{}
+		}
+		n = lo
+	}
+
+	return ShortID(n), nil
+}
+
+func (c *alphabetCodec) MaxLen() int {
+	return c.maxLen
+}
+
+// isLegacyShort reports whether str is a decimal ShortID issued before codecs were introduced.
+// Legacy ids are signed fnv hashes, so they either carry a sign or are longer than any encoded id.
+func isLegacyShort(codec Codec, str string) bool {
+	digits := strings.TrimPrefix(str, "-")
+	if digits == "" {
+		return false
+	}
+	if _, err := strconv.ParseUint(digits, 10, 64); err != nil {
+		return false
+	}
+
+	return digits != str || len(str) > codec.MaxLen()
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec_RoundTrip(t *testing.T) {
+	sids := []ShortID{0, 1, 61, 62, 1 << 40, -1, -8412391273123, Short(FullURL("https://example.com"))}
+
+	for _, codec := range []Codec{Base62, Base58, Base32} {
+		for _, sid := range sids {
+			encoded := codec.Encode(sid)
+			assert.LessOrEqual(t, len(encoded), codec.MaxLen())
+
+			decoded, err := codec.Decode(encoded)
+			assert.Nil(t, err)
+			assert.Equal(t, sid, decoded)
+		}
+	}
+}
+
+func TestCodec_Decode(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		in    string
+		want  ShortID
+		err   bool
+	}{
+		{name: "base62 single symbol", codec: Base62, in: "z", want: 61},
+		{name: "base62 invalid symbol", codec: Base62, in: "a-b", err: true},
+		{name: "base62 overflow", codec: Base62, in: "zzzzzzzzzzz", err: true},
+		{name: "base58 excluded symbol", codec: Base58, in: "0OIl", err: true},
+		{name: "base32 lowercase", codec: Base32, in: "z", want: 31},
+		{name: "base32 crockford aliases", codec: Base32, in: "oIl", want: 0<<10 | 1<<5 | 1},
+		{name: "empty", codec: Base62, in: "", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sid, err := tt.codec.Decode(tt.in)
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, sid)
+		})
+	}
+}
+
+func TestParseShort_Legacy(t *testing.T) {
+	legacy := Short(FullURL("https://example.com"))
+
+	sid, err := ParseShort(Base62, "-8412391273123")
+	assert.Nil(t, err)
+	assert.Equal(t, ShortID(-8412391273123), sid)
+
+	sid, err = ParseShort(Base62, Base62.Encode(legacy))
+	assert.Nil(t, err)
+	assert.Equal(t, legacy, sid)
+
+	sid, err = ParseShort(Base62, "12345")
+	assert.Nil(t, err)
+	assert.Equal(t, ShortID(1*62*62*62*62+2*62*62*62+3*62*62+4*62+5), sid)
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type IDStrategy string
+
+const (
+	// IDStrategyHash derives ShortID from FullURL, see SaltedShort
+	IDStrategyHash = IDStrategy("hash")
+	// IDStrategySequential issues ShortIDs from storage's monotonic sequence
+	IDStrategySequential = IDStrategy("sequential")
+	// IDStrategyRandom issues non guessable ShortIDs from crypto/rand
+	IDStrategyRandom = IDStrategy("random")
+)
+
+// maxAttempts limits the number of candidates taken by other urls for a single Put
+const maxAttempts = 16
+
+type ErrUnknownIDStrategy struct {
+	Name string
+}
+
+func (e ErrUnknownIDStrategy) Error() string {
+	return fmt.Sprintf("Storage: unknown id strategy %q", e.Name)
+}
+
+func ParseIDStrategy(name string) (IDStrategy, error) {
+	strategy := IDStrategy(strings.ToLower(name))
+	switch strategy {
+	case "":
+		return IDStrategyHash, nil
+	case IDStrategyHash, IDStrategySequential, IDStrategyRandom:
+		return strategy, nil
+	}
+
+	return IDStrategyHash, ErrUnknownIDStrategy{Name: name}
+}
+
+// IDGenerator mints candidate ShortIDs for Put and PutBatch
+type IDGenerator interface {
+	// Next returns candidate for furl, attempt is the number of previous candidates taken by other urls
+	Next(ctx context.Context, furl FullURL, attempt int) (ShortID, error)
+}
+
+type sequence func(ctx context.Context) (ShortID, error)
+
+// newIDGenerator builds generator for strategy, seq is storage's own monotonic sequence
+func newIDGenerator(strategy IDStrategy, seq sequence) IDGenerator {
+	switch strategy {
+	case IDStrategySequential:
+		return seq
+	case IDStrategyRandom:
+		return randomGenerator{}
+	}
+
+	return hashGenerator{}
+}
+
+type hashGenerator struct{}
+
+func (g hashGenerator) Next(_ context.Context, furl FullURL, attempt int) (ShortID, error) {
+	return SaltedShort(furl, attempt), nil
+}
+
+func (seq sequence) Next(ctx context.Context, _ FullURL, _ int) (ShortID, error) {
+	return seq(ctx)
+}
+
+type randomGenerator struct{}
+
+func (g randomGenerator) Next(_ context.Context, _ FullURL, _ int) (ShortID, error) {
+	buf := make([]byte, 8)
+
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return DefaultShortID, err
+		}
+
+		if sid := ShortID(binary.BigEndian.Uint64(buf)); sid != DefaultShortID {
+			return sid, nil
+		}
+	}
+}
+
+// putURL returns already saved ShortID of furl with ErrConflict,
+// otherwise saves furl under the first generated candidate which is not taken by another url
+func putURL(ctx context.Context, gen IDGenerator, furl FullURL, lookup func(furl FullURL) (ShortID, error), save func(sid ShortID) error) (ShortID, error) {
+	sid, err := lookup(furl)
+	switch err.(type) {
+	case nil:
+		return sid, ErrConflict{}
+	case ErrNotFound:
+	default:
+		return DefaultShortID, err
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		sid, err := gen.Next(ctx, furl, attempt)
+		if err != nil {
+			return DefaultShortID, err
+		}
+
+		err = save(sid)
+		if _, collided := err.(ErrCollision); collided {
+			continue
+		}
+
+		return sid, err
+	}
+
+	return DefaultShortID, ErrCollision{}
+}
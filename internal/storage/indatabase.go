@@ -4,10 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/jackc/pgconn"
-	"github.com/jackc/pgerrcode"
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
@@ -15,41 +18,53 @@ var pgInitMigrations []pgMigration
 
 const maxValuesInAnyClause = 100
 
-type toDelete struct {
-	User   User
-	Shorts []ShortID
-}
+const migrateRetryInterval = 5 * time.Second
 
 type InDatabase struct {
-	db   *sql.DB
-	junk chan toDelete
+	db       *sql.DB
+	gen      IDGenerator
+	migrator *Migrator
+	// deletes wakes up delete worker, stop asks workers to exit and delete worker to drain queue before,
+	// stopped is closed when every worker has exited
+	deletes chan struct{}
+	stop    chan struct{}
+	stopped chan struct{}
+	workers sync.WaitGroup
+	once    sync.Once
+	// migrated is closed when migrations are done, background workers wait for it
+	migrated chan struct{}
 }
 
-func NewInDatabase(dsn string) (Storage, error) {
+func NewInDatabase(dsn string, opts ...Option) (Storage, error) {
 	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx := context.Background()
-
-	for _, m := range pgInitMigrations {
-		m := m
-		//TODO async migrations
-		//go m.Run(ctx, db)
-		m.Run(ctx, db)
+	idb := InDatabase{
+		db:       db,
+		migrator: &Migrator{db: db},
+		deletes:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		migrated: make(chan struct{}),
 	}
-
-	ch := make(chan toDelete)
-
-	idb := InDatabase{db: db, junk: ch}
-	go idb.backgroundUpdate()
+	idb.gen = newIDGenerator(newOptions(opts).idStrategy, idb.nextSequence)
+	// storage is not ready until migrations are done, see PendingMigrations()
+	idb.workers.Add(3)
+	go idb.backgroundMigrate()
+	go idb.backgroundDelete()
+	go idb.backgroundExpire()
+	go func() {
+		idb.workers.Wait()
+		close(idb.stopped)
+	}()
 
 	return &idb, nil
 }
 
 func (idb *InDatabase) Get(ctx context.Context, sid ShortID) (FullURL, error) {
-	cmd := "SELECT full_url, isdeleted FROM urls WHERE short_id = $1;"
+	cmd := "SELECT full_url, isdeleted, COALESCE(expires_at <= now(), false) FROM urls WHERE short_id = $1;"
 	rows, err := idb.db.QueryContext(ctx, cmd, sid)
 	if err != nil {
 		return DefaultFullURL, err
@@ -64,44 +79,68 @@ func (idb *InDatabase) Get(ctx context.Context, sid ShortID) (FullURL, error) {
 	}
 
 	var furl FullURL
-	var isdeleted bool
-	if err = rows.Scan(&furl, &isdeleted); err != nil {
+	var isdeleted, isexpired bool
+	if err = rows.Scan(&furl, &isdeleted, &isexpired); err != nil {
 		return furl, err
 	}
 	if isdeleted {
 		return furl, ErrDeleted{}
 	}
+	if isexpired {
+		return furl, ErrExpired{}
+	}
 	return furl, nil
 }
 
-func (idb *InDatabase) Save(ctx context.Context, sid ShortID, furl FullURL) error {
-	cmd := "INSERT INTO urls(short_id, full_url) VALUES ($1, $2);"
-	if _, err := idb.db.ExecContext(ctx, cmd, sid, furl); err != nil {
-		var pgErr *pgconn.PgError
-		if !errors.As(err, &pgErr) {
-			return err
-		}
-		if !pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
+func (idb *InDatabase) Save(ctx context.Context, sid ShortID, furl FullURL, meta URLMeta) error {
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = insertURL(ctx, tx, sid, furl, meta); err != nil {
+		return err
+	}
+
+	if user, err := GetUser(ctx); err == nil {
+		if err = relateURL(ctx, tx, user, sid, meta.Tags); err != nil {
 			return err
 		}
-		return ErrConflict{}
 	}
 
-	user, err := GetUser(ctx)
+	return tx.Commit()
+}
+
+func (idb *InDatabase) Put(ctx context.Context, furl FullURL, meta URLMeta) (ShortID, error) {
+	tx, err := idb.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil
+		return DefaultShortID, err
 	}
+	defer tx.Rollback()
 
-	cmd = "INSERT INTO relations(user_id, short_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;"
-	_, err = idb.db.ExecContext(ctx, cmd, user, sid)
+	if err = lockURLs(ctx, tx, []FullURL{furl}); err != nil {
+		return DefaultShortID, err
+	}
 
-	return err
-}
+	lookup := func(furl FullURL) (ShortID, error) {
+		return lookupURL(ctx, tx, furl)
+	}
 
-func (idb *InDatabase) Put(ctx context.Context, furl FullURL) (ShortID, error) {
-	sid := Short(furl)
+	sid, err := putURL(ctx, idb.gen, furl, lookup, func(sid ShortID) error {
+		return insertURL(ctx, tx, sid, furl, meta)
+	})
+	if err != nil {
+		return sid, err
+	}
 
-	return sid, idb.Save(ctx, sid, furl)
+	if user, err := GetUser(ctx); err == nil {
+		if err = relateURL(ctx, tx, user, sid, meta.Tags); err != nil {
+			return DefaultShortID, err
+		}
+	}
+
+	return sid, tx.Commit()
 }
 
 func (idb *InDatabase) PutBatch(ctx context.Context, batch BatchRequest) (BatchResponse, error) {
@@ -116,19 +155,43 @@ func (idb *InDatabase) PutBatch(ctx context.Context, batch BatchRequest) (BatchR
 	}
 	defer tx.Rollback()
 
-	cmd := "INSERT INTO urls(short_id, full_url) VALUES ($1, $2) ON CONFLICT DO NOTHING;"
+	furls := make([]FullURL, 0, len(batch))
+	for _, burl := range batch {
+		furls = append(furls, burl.URL)
+	}
+	if err = lockURLs(ctx, tx, furls); err != nil {
+		return nil, err
+	}
+
+	cmd := "INSERT INTO urls(short_id, full_url, expires_at, created_at, creator_id, title, note) VALUES ($1, $2, $3, COALESCE($4, now()), $5, $6, $7) ON CONFLICT DO NOTHING;"
 	stmtURLs, err := tx.PrepareContext(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
 	defer stmtURLs.Close()
 
+	lookup := func(furl FullURL) (ShortID, error) {
+		return lookupURL(ctx, tx, furl)
+	}
+
 	result := BatchResponse{}
-	for corrid, furl := range batch {
-		sid := Short(furl)
+	for corrid, burl := range batch {
+		sid, err := putURL(ctx, idb.gen, burl.URL, lookup, func(sid ShortID) error {
+			inserted, err := stmtURLs.ExecContext(ctx, sid, burl.URL, nullTime(burl.Meta.ExpiresAt), nullTime(burl.Meta.CreatedAt), burl.Meta.Creator, burl.Meta.Title, burl.Meta.Note)
+			if err != nil {
+				return err
+			}
+			if n, err := inserted.RowsAffected(); err != nil || n > 0 {
+				return err
+			}
+
+			return checkSaved(ctx, tx, sid, burl.URL)
+		})
 
-		// empty return because of transaction rollback
-		if _, err = stmtURLs.ExecContext(ctx, sid, furl); err != nil {
+		switch err.(type) {
+		case nil, ErrConflict:
+		default:
+			// empty return because of transaction rollback
 			return nil, err
 		}
 
@@ -139,23 +202,319 @@ func (idb *InDatabase) PutBatch(ctx context.Context, batch BatchRequest) (BatchR
 		return result, tx.Commit()
 	}
 
-	cmd = "INSERT INTO relations(user_id, short_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;"
-	stmtRelations, err := tx.PrepareContext(ctx, cmd)
+	for corrid, sid := range result {
+		if err = relateURL(ctx, tx, user, sid, batch[corrid].Meta.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+// relateURL adds sid to user's urls in tx, not empty tags replace user's ones
+func relateURL(ctx context.Context, tx *sql.Tx, user User, sid ShortID, tags []string) error {
+	cmd := "INSERT INTO relations(user_id, short_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;"
+	if _, err := tx.ExecContext(ctx, cmd, user, sid); err != nil {
+		return err
+	}
+
+	if len(tags) == 0 || user == DefaultUser {
+		return nil
+	}
+
+	return replaceTags(ctx, tx, user, sid, tags)
+}
+
+// lockURLs serializes puts of the same urls till the end of tx, so concurrent puts
+// never save a url twice under random or sequential ids. Locks are taken in order
+// of their keys, so concurrent batches do not deadlock
+func lockURLs(ctx context.Context, tx *sql.Tx, furls []FullURL) error {
+	keys := []int64{}
+	seen := map[int64]struct{}{}
+	for _, furl := range furls {
+		key := int64(Short(furl))
+		if _, exist := seen[key]; !exist {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1);", key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertURL saves furl under sid in tx, url already saved under sid is reported by
+// ErrConflict or ErrCollision without aborting tx
+func insertURL(ctx context.Context, tx *sql.Tx, sid ShortID, furl FullURL, meta URLMeta) error {
+	cmd := "INSERT INTO urls(short_id, full_url, expires_at, created_at, creator_id, title, note) VALUES ($1, $2, $3, COALESCE($4, now()), $5, $6, $7) ON CONFLICT DO NOTHING;"
+	inserted, err := tx.ExecContext(ctx, cmd, sid, furl, nullTime(meta.ExpiresAt), nullTime(meta.CreatedAt), meta.Creator, meta.Title, meta.Note)
+	if err != nil {
+		return err
+	}
+	if n, err := inserted.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	return checkSaved(ctx, tx, sid, furl)
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// checkSaved compares furl with the one already saved under sid
+func checkSaved(ctx context.Context, q querier, sid ShortID, furl FullURL) error {
+	cmd := "SELECT full_url, COALESCE(expires_at <= now(), false) FROM urls WHERE short_id = $1;"
+
+	var saved FullURL
+	var isexpired bool
+	if err := q.QueryRowContext(ctx, cmd, sid).Scan(&saved, &isexpired); err != nil {
+		return err
+	}
+
+	// expired url is never the same as a new one
+	if isexpired {
+		return ErrCollision{}
+	}
+
+	return checkCollision(saved, furl)
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func lookupURL(ctx context.Context, q querier, furl FullURL) (ShortID, error) {
+	cmd := "SELECT short_id FROM urls WHERE full_url = $1 AND NOT isdeleted AND NOT isexpired AND (expires_at IS NULL OR expires_at > now()) LIMIT 1;"
+
+	var sid ShortID
+	err := q.QueryRowContext(ctx, cmd, furl).Scan(&sid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DefaultShortID, ErrNotFound{}
+	}
+
+	return sid, err
+}
+
+func (idb *InDatabase) nextSequence(ctx context.Context) (ShortID, error) {
+	cmd := "SELECT nextval('seq_url');"
+
+	var sid ShortID
+	err := idb.db.QueryRowContext(ctx, cmd).Scan(&sid)
+
+	return sid, err
+}
+
+func (idb *InDatabase) GetURLs(ctx context.Context, query URLsQuery) ([]UserURL, error) {
+	user, err := GetUser(ctx)
 	if err != nil {
 		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
 	}
-	defer stmtRelations.Close()
 
-	for _, sid := range result {
-		if _, err = stmtRelations.ExecContext(ctx, user, sid); err != nil {
-			return nil, err
+	key, order := "u.created_at", "ASC"
+	if query.Sort == SortByClicks {
+		key = "u.clicks"
+	}
+	if query.Desc {
+		order = "DESC"
+	}
+
+	// urls saved before metadata was introduced have no updater and creator,
+	// tags are joined by comma which is not allowed inside of them
+	cmd := "SELECT u.short_id, u.full_url, u.created_at, COALESCE(u.updated_at, u.created_at), u.expires_at, COALESCE(u.creator_id, 0), u.title, u.note, u.clicks, " +
+		"COALESCE((SELECT string_agg(t.tag, ',' ORDER BY t.tag) FROM link_tags t WHERE t.user_id = r.user_id AND t.short_id = u.short_id), '') " +
+		"FROM urls u JOIN relations r ON r.short_id = u.short_id WHERE r.user_id = $1 AND NOT u.isdeleted AND NOT u.isexpired AND strpos(u.full_url, $2) > 0"
+	args := []interface{}{user, query.Contains}
+	if query.Tag != "" {
+		args = append(args, query.Tag)
+		cmd += fmt.Sprintf(" AND EXISTS (SELECT 1 FROM link_tags t WHERE t.user_id = r.user_id AND t.short_id = u.short_id AND t.tag = $%d)", len(args))
+	}
+	if query.After != nil {
+		var value interface{} = query.After.Value
+		if query.Sort != SortByClicks {
+			value = time.UnixMicro(query.After.Value)
 		}
+		compare := ">"
+		if query.Desc {
+			compare = "<"
+		}
+		args = append(args, value, query.After.Sid)
+		cmd += fmt.Sprintf(" AND (%s, u.short_id) %s ($%d, $%d)", key, compare, len(args)-1, len(args))
+	}
+	cmd += " ORDER BY " + key + " " + order + ", u.short_id " + order
+	if query.Limit > 0 {
+		cmd += fmt.Sprintf(" LIMIT %d", query.Limit)
 	}
 
-	return result, tx.Commit()
+	rows, err := idb.db.QueryContext(ctx, cmd+";", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []UserURL{}
+	for rows.Next() {
+		var u UserURL
+		var expiresAt sql.NullTime
+		var tags string
+		if err := rows.Scan(&u.Sid, &u.URL, &u.Meta.CreatedAt, &u.Meta.UpdatedAt, &expiresAt, &u.Meta.Creator, &u.Meta.Title, &u.Meta.Note, &u.Clicks, &tags); err != nil {
+			return result, err
+		}
+		u.Meta.ExpiresAt = expiresAt.Time
+		if tags != "" {
+			u.Tags = strings.Split(tags, ",")
+		}
+		result = append(result, u)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(result) == 0 {
+		return nil, ErrNotFound{}
+	}
+
+	return result, nil
+}
+
+func (idb *InDatabase) UpdateURL(ctx context.Context, sid ShortID, furl FullURL) error {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return err
+	} else if user == DefaultUser {
+		return ErrNotFound{}
+	}
+
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cmd := "SELECT u.full_url, COALESCE(u.creator_id, 0), u.isexpired OR COALESCE(u.expires_at <= now(), false) FROM urls u JOIN relations r ON r.short_id = u.short_id WHERE r.user_id = $1 AND u.short_id = $2 AND NOT u.isdeleted LIMIT 1 FOR UPDATE OF u;"
+	var oldURL FullURL
+	var creator User
+	var isexpired bool
+	err = tx.QueryRowContext(ctx, cmd, user, sid).Scan(&oldURL, &creator, &isexpired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound{}
+	} else if err != nil {
+		return err
+	}
+	// url shared by shorten of the same destination keeps pointing where its creator wants
+	if creator != user {
+		return ErrNotCreator{}
+	}
+	if isexpired {
+		return ErrExpired{}
+	}
+	if oldURL == furl {
+		return nil
+	}
+
+	cmd = "UPDATE urls SET full_url = $2, updated_at = now() WHERE short_id = $1;"
+	if _, err = tx.ExecContext(ctx, cmd, sid, furl); err != nil {
+		return err
+	}
+
+	cmd = "INSERT INTO url_history(short_id, user_id, changed_at, old_url, new_url) VALUES ($1, $2, now(), $3, $4);"
+	if _, err = tx.ExecContext(ctx, cmd, sid, user, oldURL, furl); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (idb *InDatabase) GetHistory(ctx context.Context, sid ShortID) ([]HistoryEntry, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	cmd := "SELECT h.user_id, h.changed_at, h.old_url, h.new_url FROM url_history h WHERE h.short_id = $2 AND EXISTS (SELECT 1 FROM relations r JOIN urls u ON u.short_id = r.short_id WHERE r.user_id = $1 AND r.short_id = $2 AND NOT u.isdeleted) ORDER BY h.changed_at;"
+	rows, err := idb.db.QueryContext(ctx, cmd, user, sid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		if err := rows.Scan(&entry.User, &entry.ChangedAt, &entry.OldURL, &entry.NewURL); err != nil {
+			return result, err
+		}
+		result = append(result, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(result) == 0 {
+		return result, idb.checkOwner(ctx, user, sid)
+	}
+
+	return result, nil
+}
+
+func (idb *InDatabase) SetTags(ctx context.Context, sid ShortID, tags []string) error {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return err
+	} else if user == DefaultUser {
+		return ErrNotFound{}
+	}
+
+	if err := idb.checkOwner(ctx, user, sid); err != nil {
+		return err
+	}
+
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = replaceTags(ctx, tx, user, sid, tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceTags(ctx context.Context, tx *sql.Tx, user User, sid ShortID, tags []string) error {
+	cmd := "DELETE FROM link_tags WHERE user_id = $1 AND short_id = $2;"
+	if _, err := tx.ExecContext(ctx, cmd, user, sid); err != nil {
+		return err
+	}
+
+	cmd = "INSERT INTO link_tags(user_id, short_id, tag) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;"
+	stmt, err := tx.PrepareContext(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, tag := range tags {
+		if _, err = stmt.ExecContext(ctx, user, sid, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (idb *InDatabase) GetURLs(ctx context.Context) (SavedURLs, error) {
+func (idb *InDatabase) GetTags(ctx context.Context) ([]TagCount, error) {
 	user, err := GetUser(ctx)
 	if err != nil {
 		return nil, err
@@ -163,21 +522,20 @@ func (idb *InDatabase) GetURLs(ctx context.Context) (SavedURLs, error) {
 		return nil, ErrNotFound{}
 	}
 
-	cmd := "SELECT u.short_id, u.full_url FROM urls u JOIN relations r ON r.short_id = u.short_id WHERE r.user_id = $1 AND NOT u.isdeleted;"
+	cmd := "SELECT t.tag, count(*) FROM link_tags t JOIN urls u ON u.short_id = t.short_id WHERE t.user_id = $1 AND NOT u.isdeleted AND NOT u.isexpired GROUP BY t.tag ORDER BY t.tag;"
 	rows, err := idb.db.QueryContext(ctx, cmd, user)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result := SavedURLs{}
-	var sid ShortID
-	var furl FullURL
+	result := []TagCount{}
 	for rows.Next() {
-		if err := rows.Scan(&sid, &furl); err != nil {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.URLs); err != nil {
 			return result, err
 		}
-		result[sid] = furl
+		result = append(result, tc)
 	}
 	if err = rows.Err(); err != nil {
 		return result, err
@@ -190,27 +548,311 @@ func (idb *InDatabase) GetURLs(ctx context.Context) (SavedURLs, error) {
 	return result, nil
 }
 
-func (idb *InDatabase) DeleteURLs(ctx context.Context, sids []ShortID) error {
-	if _, err := GetUser(ctx); err != nil {
+// checkOwner returns ErrNotFound unless user owns not deleted sid
+func (idb *InDatabase) checkOwner(ctx context.Context, user User, sid ShortID) error {
+	cmd := "SELECT 1 FROM urls u JOIN relations r ON r.short_id = u.short_id WHERE r.user_id = $1 AND u.short_id = $2 AND NOT u.isdeleted LIMIT 1;"
+
+	var owned int
+	err := idb.db.QueryRowContext(ctx, cmd, user, sid).Scan(&owned)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound{}
+	}
+
+	return err
+}
+
+// DeleteURLs durably queues deletion, urls are deleted by background worker
+func (idb *InDatabase) DeleteURLs(ctx context.Context, sids []ShortID) (JobID, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	job := newDeleteJob(user, sids, time.Now())
+
+	return job.ID, idb.enqueueDeletes(ctx, user, job.Requested, job.ID)
+}
+
+func (idb *InDatabase) GetDeletedURLs(ctx context.Context, since time.Time) ([]DeletedURL, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	cmd := "SELECT u.short_id, u.full_url, u.deleted_at FROM urls u JOIN relations r ON r.short_id = u.short_id WHERE r.user_id = $1 AND u.isdeleted AND u.deleted_at >= $2 ORDER BY u.deleted_at DESC;"
+	rows, err := idb.db.QueryContext(ctx, cmd, user, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []DeletedURL{}
+	for rows.Next() {
+		var deleted DeletedURL
+		if err := rows.Scan(&deleted.Sid, &deleted.URL, &deleted.DeletedAt); err != nil {
+			return result, err
+		}
+		result = append(result, deleted)
+	}
+	if err = rows.Err(); err != nil {
+		return result, err
+	}
+
+	if len(result) == 0 {
+		return nil, ErrNotFound{}
+	}
+
+	return result, nil
+}
+
+func (idb *InDatabase) RestoreURLs(ctx context.Context, sids []ShortID, since time.Time) (SavedURLs, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	result := SavedURLs{}
+	for limit := len(sids); limit > 0; limit = len(sids) {
+		if limit > maxValuesInAnyClause {
+			limit = maxValuesInAnyClause
+		}
+		if err := idb.restore(ctx, user, sids[:limit], since, result); err != nil {
+			return result, err
+		}
+		sids = sids[limit:]
+	}
+
+	if len(result) == 0 {
+		return nil, ErrNotFound{}
+	}
+
+	return result, nil
+}
+
+// restore brings back urls of user deleted after since, relations are kept while url is deleted, so it comes back to all of its owners
+func (idb *InDatabase) restore(ctx context.Context, user User, sids []ShortID, since time.Time, result SavedURLs) error {
+	cmd := "UPDATE urls SET isdeleted = false, deleted_at = NULL FROM relations AS r WHERE r.short_id = urls.short_id AND r.user_id = $1 AND urls.isdeleted AND urls.deleted_at >= $2 AND urls.short_id = ANY ($3) RETURNING urls.short_id, urls.full_url;"
+	rows, err := idb.db.QueryContext(ctx, cmd, user, since, sids)
+	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
-	go func() {
-		_ = idb.AsyncDeleteURLs(ctx, sids)
-	}()
+	for rows.Next() {
+		var sid ShortID
+		var furl FullURL
+		if err := rows.Scan(&sid, &furl); err != nil {
+			return err
+		}
+		result[sid] = furl
+	}
 
-	return nil
+	return rows.Err()
+}
+
+func (idb *InDatabase) PurgeDeleted(ctx context.Context, before time.Time, keepBlocked bool) (PurgeStats, error) {
+	stats := PurgeStats{}
+
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return stats, err
+	}
+	defer tx.Rollback()
+
+	// blocked url keeps its row with empty full_url, so ShortID stays taken.
+	// Expired urls are purged as if they were deleted on expiry.
+	// Already blocked urls are dropped without blocking, but they are not counted, as in memory
+	cmd := "WITH purged AS (DELETE FROM urls WHERE (isdeleted AND COALESCE(deleted_at < $1, false)) OR (NOT isdeleted AND isexpired AND expires_at < $1) RETURNING full_url) " +
+		"SELECT count(*) FILTER (WHERE full_url <> '') FROM purged;"
+	if keepBlocked {
+		cmd = "WITH purged AS (UPDATE urls SET full_url = '', isdeleted = true, deleted_at = COALESCE(deleted_at, expires_at) WHERE full_url <> '' AND ((isdeleted AND COALESCE(deleted_at < $1, false)) OR (NOT isdeleted AND isexpired AND expires_at < $1)) RETURNING short_id) " +
+			"SELECT count(*) FROM purged;"
+	}
+	if err = tx.QueryRowContext(ctx, cmd, before).Scan(&stats.URLs); err != nil {
+		return stats, err
+	}
+
+	cmd = "DELETE FROM relations r WHERE NOT EXISTS (SELECT 1 FROM urls u WHERE u.short_id = r.short_id AND u.full_url <> '');"
+	result, err := tx.ExecContext(ctx, cmd)
+	if err != nil {
+		return stats, err
+	}
+	if stats.Relations, err = result.RowsAffected(); err != nil {
+		return stats, err
+	}
+
+	cmd = "DELETE FROM delete_jobs WHERE done_at < $1;"
+	if _, err = tx.ExecContext(ctx, cmd, before); err != nil {
+		return stats, err
+	}
+
+	cmd = "DELETE FROM delete_job_urls j WHERE NOT EXISTS (SELECT 1 FROM delete_jobs d WHERE d.id = j.job_id);"
+	if _, err = tx.ExecContext(ctx, cmd); err != nil {
+		return stats, err
+	}
+
+	cmd = "DELETE FROM api_keys WHERE revoked_at < $1;"
+	if _, err = tx.ExecContext(ctx, cmd, before); err != nil {
+		return stats, err
+	}
+
+	for _, table := range []string{"url_history", "url_clicks_daily", "click_events", "link_tags"} {
+		cmd = "DELETE FROM " + table + " t WHERE NOT EXISTS (SELECT 1 FROM urls u WHERE u.short_id = t.short_id AND u.full_url <> '');"
+		if _, err = tx.ExecContext(ctx, cmd); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, tx.Commit()
+}
+
+func (idb *InDatabase) SaveClicks(ctx context.Context, clicks []Clicks) error {
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cmd := "UPDATE urls SET clicks = clicks + $2, first_click = LEAST(first_click, $3), last_click = GREATEST(last_click, $4) WHERE short_id = $1;"
+	stmtURLs, err := tx.PrepareContext(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer stmtURLs.Close()
+
+	cmd = "INSERT INTO url_clicks_daily(short_id, day, clicks) VALUES ($1, $2, $3) ON CONFLICT (short_id, day) DO UPDATE SET clicks = url_clicks_daily.clicks + EXCLUDED.clicks;"
+	stmtDaily, err := tx.PrepareContext(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer stmtDaily.Close()
+
+	for _, c := range clicks {
+		if _, err = stmtURLs.ExecContext(ctx, c.Sid, c.Count, c.First, c.Last); err != nil {
+			return err
+		}
+		if _, err = stmtDaily.ExecContext(ctx, c.Sid, ClickDay(c.Day), c.Count); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (idb *InDatabase) GetStats(ctx context.Context, sid ShortID) (URLStats, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return URLStats{}, err
+	} else if user == DefaultUser {
+		return URLStats{}, ErrNotFound{}
+	}
+
+	cmd := "SELECT u.clicks, u.first_click, u.last_click FROM urls u JOIN relations r ON r.short_id = u.short_id WHERE r.user_id = $1 AND u.short_id = $2 AND NOT u.isdeleted LIMIT 1;"
+
+	result := URLStats{Daily: []DailyClicks{}}
+	var first, last sql.NullTime
+	err = idb.db.QueryRowContext(ctx, cmd, user, sid).Scan(&result.Clicks, &first, &last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return result, ErrNotFound{}
+	} else if err != nil {
+		return result, err
+	}
+	result.FirstClick = first.Time
+	result.LastClick = last.Time
+
+	cmd = "SELECT day, clicks FROM url_clicks_daily WHERE short_id = $1 ORDER BY day;"
+	rows, err := idb.db.QueryContext(ctx, cmd, sid)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var daily DailyClicks
+		if err := rows.Scan(&daily.Day, &daily.Count); err != nil {
+			return result, err
+		}
+		result.Daily = append(result.Daily, daily)
+	}
+
+	return result, rows.Err()
+}
+
+func (idb *InDatabase) SaveClickEvents(ctx context.Context, events []ClickEvent) error {
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cmd := "INSERT INTO click_events(short_id, clicked_at, referrer, user_agent, ip) VALUES ($1, $2, $3, $4, $5);"
+	stmt, err := tx.PrepareContext(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, ev := range events {
+		if _, err = stmt.ExecContext(ctx, ev.Sid, ev.Time, ev.Referrer, ev.UserAgent, ev.IP); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-func (idb *InDatabase) AsyncDeleteURLs(ctx context.Context, sids []ShortID) []ShortID {
+func (idb *InDatabase) GetAnalytics(ctx context.Context, query AnalyticsQuery) ([]AnalyticsBucket, error) {
 	user, err := GetUser(ctx)
 	if err != nil {
-		return sids
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
 	}
 
-	idb.junk <- toDelete{User: user, Shorts: sids}
+	if err := idb.checkOwner(ctx, user, query.Sid); err != nil {
+		return nil, err
+	}
 
-	return sids
+	key, order := "to_char(clicked_at AT TIME ZONE 'UTC', 'YYYY-MM-DD')", "key"
+	switch query.GroupBy {
+	case GroupByReferrer:
+		key, order = "referrer", "clicks DESC, key"
+	case GroupByAgent:
+		key, order = "user_agent", "clicks DESC, key"
+	}
+
+	cmd := "SELECT " + key + " AS key, count(*) AS clicks, count(DISTINCT ip) FROM click_events WHERE short_id = $1 AND clicked_at >= $2 AND clicked_at < $3 GROUP BY key ORDER BY " + order + ";"
+	rows, err := idb.db.QueryContext(ctx, cmd, query.Sid, query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []AnalyticsBucket{}
+	for rows.Next() {
+		var bucket AnalyticsBucket
+		if err := rows.Scan(&bucket.Key, &bucket.Clicks, &bucket.Visitors); err != nil {
+			return result, err
+		}
+		result = append(result, bucket)
+	}
+
+	return result, rows.Err()
+}
+
+func (idb *InDatabase) PurgeClickEvents(ctx context.Context, before time.Time) (int64, error) {
+	cmd := "DELETE FROM click_events WHERE clicked_at < $1;"
+
+	deleted, err := idb.db.ExecContext(ctx, cmd, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted.RowsAffected()
 }
 
 func (idb *InDatabase) NewUser(ctx context.Context) (User, error) {
@@ -251,34 +893,77 @@ func (idb *InDatabase) Ping(ctx context.Context) bool {
 		return false
 	}
 
-	////TODO async migrations
-	//for _, m := range pgInitMigrations {
-	//	if !m.isDone() {
-	//		return false
-	//	}
-	//}
+	return len(idb.PendingMigrations(ctx)) == 0
+}
 
-	return true
+func (idb *InDatabase) PendingMigrations(_ context.Context) []string {
+	result := []string{}
+	for i := range pgInitMigrations {
+		if !pgInitMigrations[i].isDone() {
+			result = append(result, pgInitMigrations[i].GetName())
+		}
+	}
+
+	return result
 }
 
-func (idb *InDatabase) backgroundUpdate() {
-	cmd := "UPDATE urls SET isdeleted = true FROM relations AS r WHERE r.short_id = urls.short_id AND r.user_id = $1 AND urls.isdeleted = false AND urls.short_id = ANY ($2);"
+// backgroundMigrate applies migrations until success, e.g. database may start later than service
+func (idb *InDatabase) backgroundMigrate() {
+	defer idb.workers.Done()
+
+	// migration in progress is rolled back on Close
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-idb.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
 	for {
-		task := <-idb.junk
-		user := task.User
-		shorts := task.Shorts
+		_, err := idb.migrator.Up(ctx)
+		if err == nil {
+			close(idb.migrated)
+			return
+		}
 
-		for limit := len(shorts); limit > 0; limit = len(shorts) {
-			if limit > maxValuesInAnyClause {
-				limit = maxValuesInAnyClause
-			}
-			toDelete := shorts[:limit]
-			shorts = shorts[limit:]
-			if _, err := idb.db.Exec(cmd, user, toDelete); err != nil {
-				log.Println("storage: indatabase: backgroundUpdate: cannot execute update query:", err.Error())
-				continue
-			}
+		log.Println("storage: indatabase: backgroundMigrate: cannot apply migrations:", err.Error())
+
+		timer := time.NewTimer(migrateRetryInterval)
+		select {
+		case <-timer.C:
+		case <-idb.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (idb *InDatabase) backgroundExpire() {
+	defer idb.workers.Done()
+
+	cmd := "UPDATE urls SET isexpired = true WHERE NOT isexpired AND expires_at <= now();"
+
+	select {
+	case <-idb.migrated:
+	case <-idb.stop:
+		return
+	}
+
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-idb.stop:
+			return
+		}
+
+		if _, err := idb.db.Exec(cmd); err != nil {
+			log.Println("storage: indatabase: backgroundExpire: cannot execute update query:", err.Error())
 		}
 	}
 }
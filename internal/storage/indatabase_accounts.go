@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
+
+func (idb *InDatabase) SaveAccount(ctx context.Context, account Account) error {
+	cmd := "INSERT INTO users(login, user_id, password_hash, created_at) VALUES ($1, $2, $3, $4);"
+	_, err := idb.db.ExecContext(ctx, cmd, account.Login, account.User, account.PasswordHash, account.CreatedAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return ErrConflict{}
+	}
+
+	return err
+}
+
+func (idb *InDatabase) GetAccount(ctx context.Context, login string) (Account, error) {
+	account := Account{Login: login}
+
+	cmd := "SELECT user_id, password_hash, created_at FROM users WHERE login = $1;"
+	err := idb.db.QueryRowContext(ctx, cmd, login).Scan(&account.User, &account.PasswordHash, &account.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Account{}, ErrNotFound{}
+	}
+
+	return account, err
+}
+
+func (idb *InDatabase) BindUser(ctx context.Context, from, to User) error {
+	if from == to || from == DefaultUser || to == DefaultUser {
+		return nil
+	}
+
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var registered int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM users WHERE user_id = $1;", from).Scan(&registered)
+	if err == nil {
+		return nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// tags of user to win for urls tagged by both users
+	commands := []string{
+		"UPDATE relations SET user_id = $2 WHERE user_id = $1 AND NOT EXISTS (SELECT 1 FROM relations r WHERE r.user_id = $2 AND r.short_id = relations.short_id);",
+		"DELETE FROM relations WHERE user_id = $1;",
+		"UPDATE link_tags SET user_id = $2 WHERE user_id = $1 AND NOT EXISTS (SELECT 1 FROM link_tags t WHERE t.user_id = $2 AND t.short_id = link_tags.short_id);",
+		"DELETE FROM link_tags WHERE user_id = $1;",
+		"UPDATE api_keys SET user_id = $2 WHERE user_id = $1;",
+		"UPDATE delete_jobs SET user_id = $2 WHERE user_id = $1;",
+		"UPDATE pending_deletes SET user_id = $2 WHERE user_id = $1;",
+		"UPDATE urls SET creator_id = $2 WHERE creator_id = $1;",
+		"UPDATE url_history SET user_id = $2 WHERE user_id = $1;",
+	}
+	for _, cmd := range commands {
+		if _, err = tx.ExecContext(ctx, cmd, from, to); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// deleteBatchSize limits deletes of many users applied by single statement
+	deleteBatchSize    = 1000
+	deletePollInterval = 10 * time.Second
+	deleteMinBackoff   = 100 * time.Millisecond
+	deleteMaxBackoff   = time.Minute
+)
+
+// enqueueDeletes saves user's deletes into pending_deletes outbox and wakes up worker,
+// deletes are tracked by job unless it is empty
+func (idb *InDatabase) enqueueDeletes(ctx context.Context, user User, sids []ShortID, job JobID) error {
+	if user == DefaultUser || (len(sids) == 0 && job == "") {
+		return nil
+	}
+
+	shorts := make([]int64, 0, len(sids))
+	for _, sid := range sids {
+		shorts = append(shorts, int64(sid))
+	}
+
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if job != "" {
+		// job without urls is done at once
+		cmd := "INSERT INTO delete_jobs(id, user_id, done_at) VALUES ($1, $2, CASE WHEN $3 THEN now() END);"
+		if _, err = tx.ExecContext(ctx, cmd, job, user, len(sids) == 0); err != nil {
+			return err
+		}
+	}
+
+	cmd := "INSERT INTO pending_deletes(user_id, short_id, job_id) SELECT $1, unnest($2::bigint[]), NULLIF($3, '');"
+	if _, err = tx.ExecContext(ctx, cmd, user, shorts, string(job)); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	select {
+	case idb.deletes <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// deleteBatch applies the oldest pending deletes and returns how many of them got applied.
+// Rows are locked with SKIP LOCKED, so replicas apply different batches concurrently
+func (idb *InDatabase) deleteBatch(ctx context.Context) (int, error) {
+	tx, err := idb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cmd := "SELECT id, user_id, short_id, COALESCE(job_id, '') FROM pending_deletes ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED;"
+	rows, err := tx.QueryContext(ctx, cmd, deleteBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, users, shorts, jobs := []int64{}, []int64{}, []int64{}, []string{}
+	for rows.Next() {
+		var id, user, sid int64
+		var job string
+		if err := rows.Scan(&id, &user, &sid, &job); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		users = append(users, user)
+		shorts = append(shorts, sid)
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// url is deleted for every job of a user related to it, even if co-owners delete it in the same batch,
+	// the others are skipped by their jobs. Url is deleted globally by its creator, or by any owner without known creator,
+	// other owners lose their relation only. Statements of the query see urls as they were before the update
+	cmd = "WITH requested AS (SELECT q.user_id, q.short_id, q.job_id, u.short_id IS NOT NULL AS deleted, COALESCE(u.creator_id, q.user_id) = q.user_id AS creator " +
+		"FROM unnest($1::bigint[], $2::bigint[], $3::varchar[]) AS q(user_id, short_id, job_id) " +
+		"LEFT JOIN LATERAL (SELECT u.short_id, u.creator_id FROM relations r JOIN urls u ON u.short_id = r.short_id WHERE r.user_id = q.user_id AND r.short_id = q.short_id AND NOT u.isdeleted LIMIT 1) u ON true), " +
+		"updated AS (UPDATE urls SET isdeleted = true, deleted_at = now() WHERE short_id IN (SELECT short_id FROM requested WHERE deleted AND creator)), " +
+		"unrelated AS (DELETE FROM relations r USING requested q WHERE q.deleted AND NOT q.creator AND r.user_id = q.user_id AND r.short_id = q.short_id), " +
+		"untagged AS (DELETE FROM link_tags t USING requested q WHERE q.deleted AND NOT q.creator AND t.user_id = q.user_id AND t.short_id = q.short_id) " +
+		"INSERT INTO delete_job_urls(job_id, short_id, deleted) SELECT job_id, short_id, deleted FROM requested WHERE job_id <> '' ON CONFLICT DO NOTHING;"
+	if _, err = tx.ExecContext(ctx, cmd, users, shorts, jobs); err != nil {
+		return 0, err
+	}
+
+	cmd = "DELETE FROM pending_deletes WHERE id = ANY ($1);"
+	if _, err = tx.ExecContext(ctx, cmd, ids); err != nil {
+		return 0, err
+	}
+
+	cmd = "UPDATE delete_jobs SET done_at = now() WHERE id = ANY ($1) AND done_at IS NULL AND NOT EXISTS (SELECT 1 FROM pending_deletes p WHERE p.job_id = delete_jobs.id);"
+	if _, err = tx.ExecContext(ctx, cmd, jobs); err != nil {
+		return 0, err
+	}
+
+	return len(ids), tx.Commit()
+}
+
+func (idb *InDatabase) GetDeleteJob(ctx context.Context, id JobID) (DeleteJob, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return DeleteJob{}, err
+	}
+
+	job := DeleteJob{ID: id, User: user, Requested: []ShortID{}}
+
+	cmd := "SELECT created_at, done_at FROM delete_jobs WHERE id = $1 AND user_id = $2;"
+	var doneAt sql.NullTime
+	err = idb.db.QueryRowContext(ctx, cmd, id, user).Scan(&job.CreatedAt, &doneAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, ErrNotFound{}
+	} else if err != nil {
+		return job, err
+	}
+	job.DoneAt = doneAt.Time
+
+	cmd = "SELECT short_id, deleted FROM delete_job_urls WHERE job_id = $1 UNION ALL SELECT short_id, NULL FROM pending_deletes WHERE job_id = $1 ORDER BY short_id;"
+	rows, err := idb.db.QueryContext(ctx, cmd, id)
+	if err != nil {
+		return job, err
+	}
+	defer rows.Close()
+
+	deleted := []ShortID{}
+	for rows.Next() {
+		var sid ShortID
+		var isDeleted sql.NullBool
+		if err := rows.Scan(&sid, &isDeleted); err != nil {
+			return job, err
+		}
+		job.Requested = append(job.Requested, sid)
+		if isDeleted.Bool {
+			deleted = append(deleted, sid)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return job, err
+	}
+
+	if job.Done() {
+		job.finish(deleted, job.DoneAt)
+	}
+
+	return job, nil
+}
+
+// deleteQueued applies pending deletes until queue is empty
+func (idb *InDatabase) deleteQueued(ctx context.Context) error {
+	for {
+		n, err := idb.deleteBatch(ctx)
+		if err != nil || n < deleteBatchSize {
+			return err
+		}
+	}
+}
+
+// backgroundDelete applies queued deletes when woken up and polls for deletes of
+// other replicas or previous runs. Failed batches stay queued and are retried with backoff
+func (idb *InDatabase) backgroundDelete() {
+	defer idb.workers.Done()
+
+	// queued deletes stay queued, if storage is closed before migrations are done
+	select {
+	case <-idb.migrated:
+	case <-idb.stop:
+		return
+	}
+
+	backoff := deleteMinBackoff
+	for {
+		wait, deletes := deletePollInterval, idb.deletes
+		if err := idb.deleteQueued(context.Background()); err != nil {
+			log.Println("storage: indatabase: backgroundDelete: cannot apply deletes:", err.Error())
+			// do not retry earlier on new deletes
+			wait, deletes = backoff, nil
+			backoff *= 2
+			if backoff > deleteMaxBackoff {
+				backoff = deleteMaxBackoff
+			}
+		} else {
+			backoff = deleteMinBackoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-deletes:
+			timer.Stop()
+		case <-idb.stop:
+			timer.Stop()
+			if err := idb.deleteQueued(context.Background()); err != nil {
+				log.Println("storage: indatabase: backgroundDelete: cannot drain deletes, they are kept queued:", err.Error())
+			}
+			return
+		}
+	}
+}
+
+// stopWorkers asks background workers to exit and delete worker to apply queued deletes before,
+// deletes left after ctx is done stay queued for the next run
+func (idb *InDatabase) stopWorkers(ctx context.Context) {
+	idb.once.Do(func() {
+		close(idb.stop)
+	})
+
+	select {
+	case <-idb.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// Close stops background workers, drains queued deletes and closes database
+func (idb *InDatabase) Close(ctx context.Context) error {
+	idb.stopWorkers(ctx)
+
+	return idb.db.Close()
+}
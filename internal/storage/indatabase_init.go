@@ -1,32 +1,27 @@
 package storage
 
-import (
-	"context"
-	"database/sql"
-	"log"
-	"sync/atomic"
-)
+import "sync/atomic"
 
+// pgMigration is numbered schema change, up commands are idempotent,
+// so databases created before schema_migrations table just record them as applied
 type pgMigration struct {
-	name     string
-	commands []string
-	done     int32
+	version int64
+	name    string
+	up      []string
+	down    []string
+	done    int32
 }
 
-func (m *pgMigration) Run(ctx context.Context, db *sql.DB) {
-	for i := 0; i < len(m.commands); i += 1 {
-		cmd := m.commands[i]
-
-		if _, err := db.ExecContext(ctx, cmd); err != nil {
-			log.Fatalf("storage: indatabase: cannot initialize database. Command '%s' failed with error:%s", cmd, err.Error())
-		}
-
-		atomic.AddInt32(&m.done, 1)
-	}
+func (m *pgMigration) isDone() bool {
+	return atomic.LoadInt32(&m.done) == 1
 }
 
-func (m *pgMigration) isDone() bool {
-	return int32(len(m.commands)) == atomic.LoadInt32(&m.done)
+func (m *pgMigration) setDone(done bool) {
+	if done {
+		atomic.StoreInt32(&m.done, 1)
+		return
+	}
+	atomic.StoreInt32(&m.done, 0)
 }
 
 func (m *pgMigration) GetName() string {
@@ -35,15 +30,19 @@ func (m *pgMigration) GetName() string {
 
 func init() {
 	pgInitMigrations = append(pgInitMigrations, pgMigration{
-		name: "user sequence",
-		commands: []string{
+		version: 1,
+		name:    "user sequence",
+		up: []string{
 			"CREATE SEQUENCE IF NOT EXISTS seq_user START 1;",
 		},
-		done: 0,
+		down: []string{
+			"DROP SEQUENCE IF EXISTS seq_user;",
+		},
 	})
 	pgInitMigrations = append(pgInitMigrations, pgMigration{
-		name: "urls table",
-		commands: []string{
+		version: 2,
+		name:    "urls table",
+		up: []string{
 			"CREATE TABLE IF NOT EXISTS urls ();",
 			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS short_id BIGINT UNIQUE NOT NULL;",
 			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS full_url VARCHAR NOT NULL;",
@@ -52,17 +51,217 @@ func init() {
 			//PostgreSQL automatically creates an index for each unique constraint and primary key constraint to enforce uniqueness.
 			//"CREATE INDEX IF NOT EXISTS idx_urls__short_id ON urls (short_id);",
 		},
-		done: 0,
+		down: []string{
+			"DROP TABLE IF EXISTS urls;",
+		},
 	})
 	pgInitMigrations = append(pgInitMigrations, pgMigration{
-		name: "relations table",
-		commands: []string{
+		version: 3,
+		name:    "relations table",
+		up: []string{
 			"CREATE TABLE IF NOT EXISTS relations ();",
 			"ALTER TABLE relations ADD COLUMN IF NOT EXISTS user_id BIGINT NOT NULL;",
 			"ALTER TABLE relations ADD COLUMN IF NOT EXISTS short_id BIGINT NOT NULL;",
 			"CREATE INDEX IF NOT EXISTS idx_relations__user_id ON relations (user_id);",
 			"CREATE INDEX IF NOT EXISTS idx_relations__short_id ON relations (short_id);",
 		},
-		done: 0,
+		down: []string{
+			"DROP TABLE IF EXISTS relations;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 4,
+		name:    "url sequence and lookup",
+		up: []string{
+			"CREATE SEQUENCE IF NOT EXISTS seq_url START 1;",
+			//btree index has row size limit, which long urls exceed
+			"CREATE INDEX IF NOT EXISTS idx_urls__full_url ON urls USING hash (full_url);",
+		},
+		down: []string{
+			"DROP INDEX IF EXISTS idx_urls__full_url;",
+			"DROP SEQUENCE IF EXISTS seq_url;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 5,
+		name:    "urls expiration",
+		up: []string{
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;",
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS isexpired BOOLEAN DEFAULT false NOT NULL;",
+			"CREATE INDEX IF NOT EXISTS idx_urls__expires_at ON urls (expires_at) WHERE NOT isexpired;",
+		},
+		down: []string{
+			"DROP INDEX IF EXISTS idx_urls__expires_at;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS isexpired;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS expires_at;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 6,
+		name:    "urls clicks",
+		up: []string{
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS clicks BIGINT DEFAULT 0 NOT NULL;",
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS first_click TIMESTAMPTZ;",
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS last_click TIMESTAMPTZ;",
+			"CREATE TABLE IF NOT EXISTS url_clicks_daily (short_id BIGINT NOT NULL, day DATE NOT NULL, clicks BIGINT NOT NULL, PRIMARY KEY (short_id, day));",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS url_clicks_daily;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS last_click;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS first_click;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS clicks;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 7,
+		name:    "click events table",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS click_events ();",
+			"ALTER TABLE click_events ADD COLUMN IF NOT EXISTS short_id BIGINT NOT NULL;",
+			"ALTER TABLE click_events ADD COLUMN IF NOT EXISTS clicked_at TIMESTAMPTZ NOT NULL;",
+			"ALTER TABLE click_events ADD COLUMN IF NOT EXISTS referrer VARCHAR DEFAULT '' NOT NULL;",
+			"ALTER TABLE click_events ADD COLUMN IF NOT EXISTS user_agent VARCHAR DEFAULT '' NOT NULL;",
+			"ALTER TABLE click_events ADD COLUMN IF NOT EXISTS ip VARCHAR DEFAULT '' NOT NULL;",
+			"CREATE INDEX IF NOT EXISTS idx_click_events__short_id_clicked_at ON click_events (short_id, clicked_at);",
+			"CREATE INDEX IF NOT EXISTS idx_click_events__clicked_at ON click_events (clicked_at);",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS click_events;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 8,
+		name:    "url history table",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS url_history ();",
+			"ALTER TABLE url_history ADD COLUMN IF NOT EXISTS short_id BIGINT NOT NULL;",
+			"ALTER TABLE url_history ADD COLUMN IF NOT EXISTS user_id BIGINT NOT NULL;",
+			"ALTER TABLE url_history ADD COLUMN IF NOT EXISTS changed_at TIMESTAMPTZ NOT NULL;",
+			"ALTER TABLE url_history ADD COLUMN IF NOT EXISTS old_url VARCHAR NOT NULL;",
+			"ALTER TABLE url_history ADD COLUMN IF NOT EXISTS new_url VARCHAR NOT NULL;",
+			"CREATE INDEX IF NOT EXISTS idx_url_history__short_id ON url_history (short_id);",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS url_history;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 9,
+		name:    "urls deletion time",
+		up: []string{
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;",
+			// urls deleted before are kept for the whole grace period from now on
+			"UPDATE urls SET deleted_at = now() WHERE isdeleted AND deleted_at IS NULL;",
+			"CREATE INDEX IF NOT EXISTS idx_urls__deleted_at ON urls (deleted_at) WHERE isdeleted;",
+		},
+		down: []string{
+			"DROP INDEX IF EXISTS idx_urls__deleted_at;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS deleted_at;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 10,
+		name:    "urls creation time",
+		up: []string{
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ DEFAULT now() NOT NULL;",
+			"CREATE INDEX IF NOT EXISTS idx_urls__created_at ON urls (created_at, short_id);",
+			"CREATE INDEX IF NOT EXISTS idx_urls__clicks ON urls (clicks, short_id);",
+		},
+		down: []string{
+			"DROP INDEX IF EXISTS idx_urls__clicks;",
+			"DROP INDEX IF EXISTS idx_urls__created_at;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS created_at;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 11,
+		name:    "urls metadata",
+		up: []string{
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;",
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS creator_id BIGINT;",
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS title VARCHAR DEFAULT '' NOT NULL;",
+			"ALTER TABLE urls ADD COLUMN IF NOT EXISTS note VARCHAR DEFAULT '' NOT NULL;",
+		},
+		down: []string{
+			"ALTER TABLE urls DROP COLUMN IF EXISTS note;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS title;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS creator_id;",
+			"ALTER TABLE urls DROP COLUMN IF EXISTS updated_at;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 12,
+		name:    "link tags table",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS link_tags ();",
+			"ALTER TABLE link_tags ADD COLUMN IF NOT EXISTS user_id BIGINT NOT NULL;",
+			"ALTER TABLE link_tags ADD COLUMN IF NOT EXISTS short_id BIGINT NOT NULL;",
+			"ALTER TABLE link_tags ADD COLUMN IF NOT EXISTS tag VARCHAR NOT NULL;",
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_link_tags__user_id_short_id_tag ON link_tags (user_id, short_id, tag);",
+			"CREATE INDEX IF NOT EXISTS idx_link_tags__user_id_tag ON link_tags (user_id, tag);",
+			"CREATE INDEX IF NOT EXISTS idx_link_tags__short_id ON link_tags (short_id);",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS link_tags;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 13,
+		name:    "pending deletes table",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS pending_deletes (id BIGSERIAL PRIMARY KEY, user_id BIGINT NOT NULL, short_id BIGINT NOT NULL, queued_at TIMESTAMPTZ DEFAULT now() NOT NULL);",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS pending_deletes;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 14,
+		name:    "delete jobs tables",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS delete_jobs (id VARCHAR PRIMARY KEY, user_id BIGINT NOT NULL, created_at TIMESTAMPTZ DEFAULT now() NOT NULL, done_at TIMESTAMPTZ);",
+			"CREATE TABLE IF NOT EXISTS delete_job_urls (job_id VARCHAR NOT NULL, short_id BIGINT NOT NULL, deleted BOOLEAN NOT NULL, PRIMARY KEY (job_id, short_id));",
+			"ALTER TABLE pending_deletes ADD COLUMN IF NOT EXISTS job_id VARCHAR;",
+			"CREATE INDEX IF NOT EXISTS idx_pending_deletes__job_id ON pending_deletes (job_id);",
+		},
+		down: []string{
+			"DROP INDEX IF EXISTS idx_pending_deletes__job_id;",
+			"ALTER TABLE pending_deletes DROP COLUMN IF EXISTS job_id;",
+			"DROP TABLE IF EXISTS delete_job_urls;",
+			"DROP TABLE IF EXISTS delete_jobs;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 15,
+		name:    "api keys table",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS api_keys (id VARCHAR PRIMARY KEY, user_id BIGINT NOT NULL, name VARCHAR DEFAULT '' NOT NULL, hash VARCHAR UNIQUE NOT NULL, scopes VARCHAR NOT NULL, created_at TIMESTAMPTZ DEFAULT now() NOT NULL, revoked_at TIMESTAMPTZ);",
+			"CREATE INDEX IF NOT EXISTS idx_api_keys__user_id ON api_keys (user_id);",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS api_keys;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 16,
+		name:    "users table",
+		up: []string{
+			"CREATE TABLE IF NOT EXISTS users (login VARCHAR PRIMARY KEY, user_id BIGINT UNIQUE NOT NULL, password_hash VARCHAR NOT NULL, created_at TIMESTAMPTZ DEFAULT now() NOT NULL);",
+		},
+		down: []string{
+			"DROP TABLE IF EXISTS users;",
+		},
+	})
+	pgInitMigrations = append(pgInitMigrations, pgMigration{
+		version: 17,
+		name:    "unique relations",
+		up: []string{
+			//relations were added without conflict target, so the same url may be related to user twice
+			"DELETE FROM relations a USING relations b WHERE a.user_id = b.user_id AND a.short_id = b.short_id AND a.ctid > b.ctid;",
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_relations__user_id_short_id ON relations (user_id, short_id);",
+		},
+		down: []string{
+			"DROP INDEX IF EXISTS idx_relations__user_id_short_id;",
+		},
 	})
 }
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPgInitMigrations(t *testing.T) {
+	assert.NotEmpty(t, pgInitMigrations)
+
+	previous := int64(0)
+	for _, mig := range pgInitMigrations {
+		// versions are unique and applied in order they are declared
+		assert.Greater(t, mig.version, previous, "migration %q", mig.name)
+		assert.NotEmpty(t, mig.name, "migration %d", mig.version)
+		assert.NotEmpty(t, mig.up, "migration %d", mig.version)
+		assert.NotEmpty(t, mig.down, "migration %d", mig.version)
+		previous = mig.version
+	}
+}
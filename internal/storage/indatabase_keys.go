@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+func (idb *InDatabase) SaveAPIKey(ctx context.Context, key APIKey) (APIKeyID, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return "", err
+	} else if user == DefaultUser {
+		return "", ErrNotFound{}
+	}
+
+	key.ID = newAPIKeyID()
+
+	cmd := "INSERT INTO api_keys(id, user_id, name, hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6);"
+	_, err = idb.db.ExecContext(ctx, cmd, key.ID, user, key.Name, key.Hash, strings.Join(key.Scopes, ","), key.CreatedAt)
+
+	return key.ID, err
+}
+
+func (idb *InDatabase) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	cmd := "SELECT id, user_id, name, hash, scopes, created_at FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at, id;"
+	rows, err := idb.db.QueryContext(ctx, cmd, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, key)
+	}
+
+	return result, rows.Err()
+}
+
+func (idb *InDatabase) RevokeAPIKey(ctx context.Context, id APIKeyID) error {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return err
+	} else if user == DefaultUser {
+		return ErrNotFound{}
+	}
+
+	cmd := "UPDATE api_keys SET revoked_at = $3 WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;"
+	result, err := idb.db.ExecContext(ctx, cmd, id, user, time.Now())
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return ErrNotFound{}
+	}
+
+	return nil
+}
+
+func (idb *InDatabase) GetAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	cmd := "SELECT id, user_id, name, hash, scopes, created_at FROM api_keys WHERE hash = $1 AND revoked_at IS NULL;"
+	key, err := scanAPIKey(idb.db.QueryRowContext(ctx, cmd, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrNotFound{}
+	}
+
+	return key, err
+}
+
+// rowScanner is either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	key := APIKey{}
+	var scopes string
+	if err := row.Scan(&key.ID, &key.User, &key.Name, &key.Hash, &scopes, &key.CreatedAt); err != nil {
+		return key, err
+	}
+
+	key.Scopes = []string{}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+
+	return key, nil
+}
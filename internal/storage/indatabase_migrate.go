@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// pgMigrationsLock is advisory lock key, which serializes migrations of concurrently started replicas
+const pgMigrationsLock = int64(0x75726c73)
+
+// MigrationStatus is numbered schema migration, AppliedAt is zero for pending one
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migrator applies and rolls back schema migrations of InDatabase
+type Migrator struct {
+	db *sql.DB
+}
+
+func NewMigrator(dsn string) (*Migrator, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db}, nil
+}
+
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// Status returns every known migration ordered by version. It neither waits for
+// running migrations nor creates schema_migrations table, so it is safe to run anytime
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var exist bool
+	if err := m.db.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL;").Scan(&exist); err != nil {
+		return nil, err
+	}
+
+	applied := map[int64]time.Time{}
+	if exist {
+		var err error
+		if applied, err = appliedMigrations(ctx, m.db); err != nil {
+			return nil, err
+		}
+	}
+
+	result := []MigrationStatus{}
+	for i := range pgInitMigrations {
+		mig := &pgInitMigrations[i]
+		result = append(result, MigrationStatus{Version: mig.version, Name: mig.name, AppliedAt: applied[mig.version]})
+	}
+
+	return result, nil
+}
+
+// Up applies every pending migration and returns them
+func (m *Migrator) Up(ctx context.Context) ([]MigrationStatus, error) {
+	result := []MigrationStatus{}
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := range pgInitMigrations {
+			mig := &pgInitMigrations[i]
+			if _, exist := applied[mig.version]; exist {
+				mig.setDone(true)
+				continue
+			}
+
+			cmd := "INSERT INTO schema_migrations(version, name) VALUES ($1, $2);"
+			if err := migrate(ctx, conn, mig.up, cmd, mig.version, mig.name); err != nil {
+				return fmt.Errorf("migration %d %q: %w", mig.version, mig.name, err)
+			}
+			mig.setDone(true)
+
+			result = append(result, MigrationStatus{Version: mig.version, Name: mig.name, AppliedAt: time.Now()})
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+// Down rolls back given number of the latest applied migrations and returns them
+func (m *Migrator) Down(ctx context.Context, steps int) ([]MigrationStatus, error) {
+	result := []MigrationStatus{}
+
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		latest := []*pgMigration{}
+		for i := range pgInitMigrations {
+			if _, exist := applied[pgInitMigrations[i].version]; exist {
+				latest = append(latest, &pgInitMigrations[i])
+			}
+		}
+		sort.Slice(latest, func(i, j int) bool {
+			return latest[i].version > latest[j].version
+		})
+		if steps < len(latest) {
+			latest = latest[:steps]
+		}
+
+		for _, mig := range latest {
+			cmd := "DELETE FROM schema_migrations WHERE version = $1;"
+			if err := migrate(ctx, conn, mig.down, cmd, mig.version); err != nil {
+				return fmt.Errorf("rollback %d %q: %w", mig.version, mig.name, err)
+			}
+			mig.setDone(false)
+
+			result = append(result, MigrationStatus{Version: mig.version, Name: mig.name, AppliedAt: applied[mig.version]})
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+// locked runs f holding migrations lock on a single connection, because advisory locks belong to session
+func (m *Migrator) locked(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", pgMigrationsLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1);", pgMigrationsLock)
+
+	cmd := "CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT PRIMARY KEY, name VARCHAR NOT NULL, applied_at TIMESTAMPTZ DEFAULT now() NOT NULL);"
+	if _, err = conn.ExecContext(ctx, cmd); err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func appliedMigrations(ctx context.Context, q rowsQuerier) (map[int64]time.Time, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return result, err
+		}
+		result[version] = appliedAt
+	}
+
+	return result, rows.Err()
+}
+
+// migrate runs commands and records it by cmd with args in a single transaction
+func migrate(ctx context.Context, conn *sql.Conn, commands []string, cmd string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, command := range commands {
+		if _, err = tx.ExecContext(ctx, command); err != nil {
+			return fmt.Errorf("command '%s' failed: %w", command, err)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, cmd, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
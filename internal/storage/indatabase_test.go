@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestInDatabase returns migrated database storage of DATABASE_DSN, test is skipped without it
+func newTestInDatabase(t *testing.T) Storage {
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("DATABASE_DSN is not set")
+	}
+
+	idb, err := NewInDatabase(dsn)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		idb.Close(context.Background())
+	})
+
+	ctx := context.Background()
+	if !assert.Eventually(t, func() bool { return len(idb.PendingMigrations(ctx)) == 0 }, 10*time.Second, 10*time.Millisecond) {
+		t.FailNow()
+	}
+
+	return idb
+}
+
+func TestInDatabase_GetURLsRelatedTwice(t *testing.T) {
+	idb := newTestInDatabase(t)
+	user, err := idb.NewUser(context.Background())
+	assert.Nil(t, err)
+	ctx := PutUser(context.Background(), user)
+	now := time.Now()
+
+	sids := []ShortID{}
+	for i := 0; i < 2; i++ {
+		furl := FullURL(fmt.Sprintf("https://example.com/related-twice/%d/%d", now.UnixNano(), i))
+		sid, err := idb.Put(ctx, furl, URLMeta{CreatedAt: now.Add(time.Duration(i) * time.Second)})
+		assert.Nil(t, err)
+		sids = append(sids, sid)
+
+		// relating already related url keeps single relation
+		for j := 0; j < 2; j++ {
+			_, err = idb.PutBatch(ctx, BatchRequest{"1": {URL: furl}})
+			assert.Nil(t, err)
+		}
+	}
+
+	first, err := idb.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Limit: 1})
+	assert.Nil(t, err)
+	if !assert.Len(t, first, 1) {
+		return
+	}
+	assert.Equal(t, sids[0], first[0].Sid)
+
+	cursor := first[0].Cursor(SortByCreated)
+	second, err := idb.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Limit: 1, After: &cursor})
+	assert.Nil(t, err)
+	if !assert.Len(t, second, 1) {
+		return
+	}
+	assert.Equal(t, sids[1], second[0].Sid)
+
+	cursor = second[0].Cursor(SortByCreated)
+	_, err = idb.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Limit: 1, After: &cursor})
+	assert.IsType(t, ErrNotFound{}, err)
+}
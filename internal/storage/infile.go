@@ -2,36 +2,108 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 type InFile struct {
-	ims      Storage
+	ims      *InMemory
 	filename string
-	seek     int64
+	// mutex guards file and seek, so own updates are never read back
+	mutex sync.Mutex
+	seek  int64
+	// click events are kept in a separate file, which is rewritten on purge
+	eventsMutex sync.Mutex
+	// writers counts updates written in background, so Close waits for them.
+	// stopMutex guards adding writers against closing stop, after which updates are written in place
+	writers   sync.WaitGroup
+	stopMutex sync.Mutex
+	stop      chan struct{}
+	once      sync.Once
 }
 
+// operations of storage file lines, empty one is saved or deleted url
+const (
+	opClicks  = "clicks"
+	opUpdate  = "update"
+	opRestore = "restore"
+	opBlock   = "block"
+	opTags    = "tags"
+	opJob     = "job"
+	opKey     = "key"
+	opAccount = "account"
+	opBind    = "bind"
+	opRelate  = "relate"
+)
+
 type shortedURL struct {
-	Sid     ShortID `json:"id"`
-	Furl    FullURL `json:"url"`
-	User    User    `json:"user"`
-	Deleted bool    `json:"deleted"`
+	Op        string     `json:"op,omitempty"`
+	Sid       ShortID    `json:"id"`
+	Furl      FullURL    `json:"url,omitempty"`
+	User      User       `json:"user,omitempty"`
+	Deleted   bool       `json:"deleted,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Clicks    *Clicks    `json:"clicks,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	Job       *DeleteJob `json:"job,omitempty"`
+	Key       *APIKey    `json:"key,omitempty"`
+	Account   *Account   `json:"account,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// From is user, whose urls are bound to User
+	From User `json:"from,omitempty"`
+	// Time is when operation happened
+	Time *time.Time `json:"time,omitempty"`
+}
+
+func newShortedURL(sid ShortID, furl FullURL, user User, meta URLMeta) shortedURL {
+	s := shortedURL{Sid: sid, Furl: furl, User: user, Title: meta.Title, Note: meta.Note, Tags: meta.Tags}
+	if !meta.CreatedAt.IsZero() {
+		createdAt := meta.CreatedAt
+		s.CreatedAt = &createdAt
+	}
+	if !meta.ExpiresAt.IsZero() {
+		expiresAt := meta.ExpiresAt
+		s.ExpiresAt = &expiresAt
+	}
+
+	return s
+}
+
+func (s shortedURL) meta() URLMeta {
+	// saved url line is written by its creator
+	meta := URLMeta{Creator: s.User, Title: s.Title, Note: s.Note, Tags: s.Tags}
+	if s.CreatedAt != nil {
+		meta.CreatedAt = *s.CreatedAt
+	}
+	if s.ExpiresAt != nil {
+		meta.ExpiresAt = *s.ExpiresAt
+	}
+
+	return meta
 }
 
-func NewInFile(filename string) (Storage, error) {
-	ifs := InFile{ims: NewInMemory(), filename: filename, seek: 0}
+func NewInFile(filename string, opts ...Option) (Storage, error) {
+	ifs := InFile{ims: newInMemory(newOptions(opts)), filename: filename, seek: 0, stop: make(chan struct{})}
 
 	if err := ifs.readUpdates(); err != nil {
 		return nil, err
 	}
 
+	if err := ifs.readEvents(); err != nil {
+		return nil, err
+	}
+
 	go ifs.backgroundUpdate()
 
 	return &ifs, nil
@@ -41,73 +113,389 @@ func (ifs *InFile) Get(ctx context.Context, sid ShortID) (FullURL, error) {
 	return ifs.ims.Get(ctx, sid)
 }
 
-func (ifs *InFile) Save(ctx context.Context, sid ShortID, furl FullURL) error {
-	if err := ifs.ims.Save(ctx, sid, furl); err != nil {
+func (ifs *InFile) Save(ctx context.Context, sid ShortID, furl FullURL, meta URLMeta) error {
+	if err := ifs.ims.Save(ctx, sid, furl, meta); err != nil {
 		return err
 	}
 
 	user, _ := GetUser(ctx)
 	update := []shortedURL{}
-	update = append(update, shortedURL{Sid: sid, Furl: furl, User: user})
-	go ifs.writeUpdates(update)
+	update = append(update, newShortedURL(sid, furl, user, meta))
+	ifs.background(func() {
+		ifs.writeUpdates(update)
+	})
 
 	return nil
 }
 
-func (ifs *InFile) Put(ctx context.Context, furl FullURL) (ShortID, error) {
-	sid := Short(furl)
-
-	return sid, ifs.Save(ctx, sid, furl)
+func (ifs *InFile) Put(ctx context.Context, furl FullURL, meta URLMeta) (ShortID, error) {
+	return putURL(ctx, ifs.ims.gen, furl, ifs.ims.lookup, func(sid ShortID) error {
+		return ifs.Save(ctx, sid, furl, meta)
+	})
 }
 
 func (ifs *InFile) PutBatch(ctx context.Context, batch BatchRequest) (BatchResponse, error) {
-	response, err := ifs.ims.PutBatch(ctx, batch)
+	user, err := GetUser(ctx)
 	if err != nil {
-		return response, err
+		return nil, err
 	}
 
-	user, _ := GetUser(ctx)
+	result := BatchResponse{}
 	update := []shortedURL{}
-	for corrid, sid := range response {
-		update = append(update, shortedURL{Sid: sid, Furl: batch[corrid], User: user})
+	for corrid, burl := range batch {
+		var sid ShortID
+		sid, err = ifs.ims.Put(ctx, burl.URL, burl.Meta)
+
+		switch err.(type) {
+		case nil:
+			update = append(update, newShortedURL(sid, burl.URL, user, burl.Meta))
+		case ErrConflict:
+			// already saved url is only related to user
+			err = nil
+			if !ifs.ims.relate(ctx, user, sid, burl.Meta.Tags) {
+				continue
+			}
+			update = append(update, shortedURL{Op: opRelate, Sid: sid, User: user, Tags: burl.Meta.Tags})
+		}
+		if err != nil {
+			break
+		}
+
+		result[corrid] = sid
 	}
-	go ifs.writeUpdates(update)
 
-	return response, nil
+	// urls saved before error are kept in memory, so they are written too
+	ifs.background(func() {
+		ifs.writeUpdates(update)
+	})
+
+	return result, err
 }
 
-func (ifs *InFile) GetURLs(ctx context.Context) (SavedURLs, error) {
-	return ifs.ims.GetURLs(ctx)
+func (ifs *InFile) GetURLs(ctx context.Context, query URLsQuery) ([]UserURL, error) {
+	return ifs.ims.GetURLs(ctx, query)
 }
 
-func (ifs *InFile) DeleteURLs(ctx context.Context, sids []ShortID) error {
-	if _, err := GetUser(ctx); err != nil {
+func (ifs *InFile) UpdateURL(ctx context.Context, sid ShortID, furl FullURL) error {
+	user, err := GetUser(ctx)
+	if err != nil {
 		return err
 	}
 
-	go func() {
-		_ = ifs.AsyncDeleteURLs(ctx, sids)
-	}()
+	if err := ifs.ims.checkCreator(user, sid); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := ifs.ims.update(HistoryEntry{User: user, ChangedAt: now, NewURL: furl}, sid); err != nil {
+		return err
+	}
+
+	ifs.writeUpdates([]shortedURL{{Op: opUpdate, Sid: sid, Furl: furl, User: user, Time: &now}})
+
+	return nil
+}
+
+func (ifs *InFile) GetHistory(ctx context.Context, sid ShortID) ([]HistoryEntry, error) {
+	return ifs.ims.GetHistory(ctx, sid)
+}
+
+func (ifs *InFile) SetTags(ctx context.Context, sid ShortID, tags []string) error {
+	if err := ifs.ims.SetTags(ctx, sid, tags); err != nil {
+		return err
+	}
+
+	user, _ := GetUser(ctx)
+	ifs.writeUpdates([]shortedURL{{Op: opTags, Sid: sid, User: user, Tags: tags}})
 
 	return nil
 }
 
-func (ifs *InFile) AsyncDeleteURLs(ctx context.Context, sids []ShortID) []ShortID {
-	result := ifs.ims.AsyncDeleteURLs(ctx, sids)
+func (ifs *InFile) GetTags(ctx context.Context) ([]TagCount, error) {
+	return ifs.ims.GetTags(ctx)
+}
+
+func (ifs *InFile) DeleteURLs(ctx context.Context, sids []ShortID) (JobID, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	job := newDeleteJob(user, sids, time.Now())
+	ifs.saveJob(job)
+
+	ifs.background(func() {
+		deleted := ifs.remove(user, job.Requested)
+		job.finish(deleted, time.Now())
+		ifs.saveJob(job)
+	})
+
+	return job.ID, nil
+}
+
+func (ifs *InFile) saveJob(job DeleteJob) {
+	ifs.ims.saveJob(job)
+	ifs.writeUpdates([]shortedURL{{Op: opJob, User: job.User, Job: &job}})
+}
+
+func (ifs *InFile) GetDeleteJob(ctx context.Context, id JobID) (DeleteJob, error) {
+	return ifs.ims.GetDeleteJob(ctx, id)
+}
+
+func (ifs *InFile) SaveAPIKey(ctx context.Context, key APIKey) (APIKeyID, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return "", err
+	} else if user == DefaultUser {
+		return "", ErrNotFound{}
+	}
+
+	key.ID, key.User = newAPIKeyID(), user
+	ifs.saveAPIKey(key)
+
+	return key.ID, nil
+}
+
+func (ifs *InFile) saveAPIKey(key APIKey) {
+	ifs.ims.saveAPIKey(key)
+	ifs.writeUpdates([]shortedURL{{Op: opKey, User: key.User, Key: &key}})
+}
+
+func (ifs *InFile) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return ifs.ims.GetAPIKeys(ctx)
+}
 
+func (ifs *InFile) RevokeAPIKey(ctx context.Context, id APIKeyID) error {
 	user, err := GetUser(ctx)
 	if err != nil {
-		return result
+		return err
+	} else if user == DefaultUser {
+		return ErrNotFound{}
+	}
+
+	key, err := ifs.ims.revokeAPIKey(user, id, time.Now())
+	if err != nil {
+		return err
 	}
+	ifs.writeUpdates([]shortedURL{{Op: opKey, User: key.User, Key: &key}})
+
+	return nil
+}
+
+func (ifs *InFile) GetAPIKey(ctx context.Context, hash string) (APIKey, error) {
+	return ifs.ims.GetAPIKey(ctx, hash)
+}
+
+func (ifs *InFile) SaveAccount(ctx context.Context, account Account) error {
+	if err := ifs.ims.SaveAccount(ctx, account); err != nil {
+		return err
+	}
+	ifs.writeUpdates([]shortedURL{{Op: opAccount, User: account.User, Account: &account}})
+
+	return nil
+}
+
+func (ifs *InFile) GetAccount(ctx context.Context, login string) (Account, error) {
+	return ifs.ims.GetAccount(ctx, login)
+}
+
+func (ifs *InFile) BindUser(ctx context.Context, from, to User) error {
+	if ifs.ims.bindUser(from, to) {
+		ifs.writeUpdates([]shortedURL{{Op: opBind, User: to, From: from}})
+	}
+
+	return nil
+}
+
+func (ifs *InFile) remove(user User, sids []ShortID) []ShortID {
+	now := time.Now()
+	result := ifs.ims.remove(user, sids, now)
 
 	update := []shortedURL{}
 	for _, sid := range result {
-		update = append(update, shortedURL{Sid: sid, Furl: DefaultFullURL, User: user, Deleted: true})
+		update = append(update, shortedURL{Sid: sid, Furl: DefaultFullURL, User: user, Deleted: true, Time: &now})
 	}
 	ifs.writeUpdates(update)
 	return result
 }
 
+func (ifs *InFile) GetDeletedURLs(ctx context.Context, since time.Time) ([]DeletedURL, error) {
+	return ifs.ims.GetDeletedURLs(ctx, since)
+}
+
+func (ifs *InFile) RestoreURLs(ctx context.Context, sids []ShortID, since time.Time) (SavedURLs, error) {
+	result, err := ifs.ims.RestoreURLs(ctx, sids, since)
+	if err != nil {
+		return result, err
+	}
+
+	user, err := GetUser(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	now := time.Now()
+	update := []shortedURL{}
+	for sid := range result {
+		update = append(update, shortedURL{Op: opRestore, Sid: sid, User: user, Time: &now})
+	}
+	ifs.writeUpdates(update)
+
+	return result, nil
+}
+
+func (ifs *InFile) SaveClicks(ctx context.Context, clicks []Clicks) error {
+	if err := ifs.ims.SaveClicks(ctx, clicks); err != nil {
+		return err
+	}
+
+	update := []shortedURL{}
+	for _, c := range clicks {
+		c := c
+		update = append(update, shortedURL{Op: opClicks, Sid: c.Sid, Clicks: &c})
+	}
+	ifs.writeUpdates(update)
+
+	return nil
+}
+
+func (ifs *InFile) GetStats(ctx context.Context, sid ShortID) (URLStats, error) {
+	return ifs.ims.GetStats(ctx, sid)
+}
+
+func (ifs *InFile) SaveClickEvents(ctx context.Context, events []ClickEvent) error {
+	ifs.eventsMutex.Lock()
+	defer ifs.eventsMutex.Unlock()
+
+	file, err := os.OpenFile(ifs.eventsFilename(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := writeEvents(file, events); err != nil {
+		return err
+	}
+
+	return ifs.ims.SaveClickEvents(ctx, events)
+}
+
+func (ifs *InFile) GetAnalytics(ctx context.Context, query AnalyticsQuery) ([]AnalyticsBucket, error) {
+	return ifs.ims.GetAnalytics(ctx, query)
+}
+
+func (ifs *InFile) PurgeClickEvents(ctx context.Context, before time.Time) (int64, error) {
+	ifs.eventsMutex.Lock()
+	defer ifs.eventsMutex.Unlock()
+
+	purged, err := ifs.ims.PurgeClickEvents(ctx, before)
+	if err != nil || purged == 0 {
+		return purged, err
+	}
+
+	return purged, ifs.rewriteEvents()
+}
+
+// rewriteEvents replaces events file with events kept in memory
+func (ifs *InFile) rewriteEvents() error {
+	tmpFilename := ifs.eventsFilename() + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = writeEvents(file, ifs.ims.clickEvents()); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilename, ifs.eventsFilename())
+}
+
+func (ifs *InFile) PurgeDeleted(_ context.Context, before time.Time, keepBlocked bool) (PurgeStats, error) {
+	ifs.mutex.Lock()
+	defer ifs.mutex.Unlock()
+
+	// purge updates of other processes too
+	if err := ifs.readFile(); err != nil {
+		return PurgeStats{}, err
+	}
+
+	stats, purged := ifs.ims.purge(before, keepBlocked)
+	if len(purged) == 0 {
+		return stats, nil
+	}
+
+	if err := ifs.compact(purged, keepBlocked); err != nil {
+		return stats, err
+	}
+
+	ifs.eventsMutex.Lock()
+	defer ifs.eventsMutex.Unlock()
+
+	return stats, ifs.rewriteEvents()
+}
+
+// compact drops every line of purged urls from storage file and leaves
+// a single block line per url if their ShortIDs should stay taken
+func (ifs *InFile) compact(purged []ShortID, keepBlocked bool) error {
+	drop := map[ShortID]struct{}{}
+	for _, sid := range purged {
+		drop[sid] = struct{}{}
+	}
+
+	content, err := os.ReadFile(ifs.filename)
+	if err != nil {
+		return err
+	}
+
+	kept := []byte{}
+	for _, line := range bytes.SplitAfter(content, []byte{'\n'}) {
+		s := shortedURL{}
+		if err := json.Unmarshal(line, &s); err == nil {
+			// lines of users are kept, their Sid is zero
+			switch s.Op {
+			case opJob, opKey, opAccount, opBind:
+			default:
+				if _, exist := drop[s.Sid]; exist {
+					continue
+				}
+			}
+			// purged jobs and keys
+			if s.Op == opJob && s.Job != nil && !ifs.ims.hasJob(s.Job.ID) {
+				continue
+			}
+			if s.Op == opKey && s.Key != nil && !ifs.ims.hasAPIKey(s.Key.ID) {
+				continue
+			}
+		}
+		kept = append(kept, line...)
+	}
+
+	if keepBlocked {
+		for _, sid := range purged {
+			marshaled, _ := json.Marshal(shortedURL{Op: opBlock, Sid: sid})
+			kept = append(kept, marshaled...)
+			kept = append(kept, '\n')
+		}
+	}
+
+	tmpFilename := ifs.filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, kept, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, ifs.filename); err != nil {
+		return err
+	}
+
+	ifs.seek = int64(len(kept))
+
+	return nil
+}
+
 func (ifs *InFile) NewUser(ctx context.Context) (User, error) {
 	return ifs.ims.NewUser(ctx)
 }
@@ -130,6 +518,52 @@ func (ifs *InFile) Ping(ctx context.Context) bool {
 	return true
 }
 
+func (ifs *InFile) PendingMigrations(ctx context.Context) []string {
+	return ifs.ims.PendingMigrations(ctx)
+}
+
+// Close waits for updates written in background, updates left after ctx is done may be lost
+func (ifs *InFile) Close(ctx context.Context) error {
+	ifs.once.Do(func() {
+		ifs.stopMutex.Lock()
+		close(ifs.stop)
+		ifs.stopMutex.Unlock()
+	})
+
+	written := make(chan struct{})
+	go func() {
+		ifs.writers.Wait()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return ifs.ims.Close(ctx)
+}
+
+// background runs f tracked by Close, f is run in place once storage is closing
+func (ifs *InFile) background(f func()) {
+	ifs.stopMutex.Lock()
+	select {
+	case <-ifs.stop:
+		ifs.stopMutex.Unlock()
+		f()
+		return
+	default:
+	}
+	ifs.writers.Add(1)
+	ifs.stopMutex.Unlock()
+
+	go func() {
+		defer ifs.writers.Done()
+		f()
+	}()
+}
+
 func (ifs *InFile) backgroundUpdate() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -145,6 +579,13 @@ func (ifs *InFile) backgroundUpdate() {
 	for {
 		select {
 		case event := <-watcher.Events:
+			// storage file is replaced on compaction, so watch the new one
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				if err := watcher.Add(ifs.filename); err != nil {
+					log.Println("storage: infile: Async: cannot watch replaced storage file:", err.Error())
+				}
+				continue
+			}
 			if event.Op&fsnotify.Write != fsnotify.Write {
 				continue
 			}
@@ -153,11 +594,21 @@ func (ifs *InFile) backgroundUpdate() {
 			}
 		case err := <-watcher.Errors:
 			log.Println("storage: infile: Async error:", err.Error())
+		case <-ifs.stop:
+			return
 		}
 	}
 }
 
 func (ifs *InFile) writeUpdates(s []shortedURL) {
+	ifs.mutex.Lock()
+	defer ifs.mutex.Unlock()
+
+	// apply updates of other processes first, because seek moves over the whole file
+	if err := ifs.readFile(); err != nil {
+		log.Println("storage: infile: writeUpdate: cannot read storage file:", err.Error())
+	}
+
 	file, err := os.OpenFile(ifs.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		log.Println("storage: infile: writeUpdate: cannot open storage file:", err.Error())
@@ -188,6 +639,13 @@ func (ifs *InFile) writeUpdates(s []shortedURL) {
 }
 
 func (ifs *InFile) readUpdates() error {
+	ifs.mutex.Lock()
+	defer ifs.mutex.Unlock()
+
+	return ifs.readFile()
+}
+
+func (ifs *InFile) readFile() error {
 	file, err := os.OpenFile(ifs.filename, os.O_RDONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return err
@@ -215,19 +673,14 @@ func (ifs *InFile) readUpdates() error {
 		if line, err = buffered.ReadBytes('\n'); err != nil {
 			break
 		}
+		s = shortedURL{}
 		if err := json.Unmarshal(line, &s); err != nil {
 			log.Println("storage: infile: readUpdates: cannot Unmarshal shortedURL:", err.Error())
 			continue
 		}
 
-		ctx := context.WithValue(context.Background(), UserCtxKey{}, fmt.Sprint(s.User))
-		if s.Deleted {
-			ifs.ims.AsyncDeleteURLs(ctx, []ShortID{s.Sid})
-			continue
-		}
-
-		if err := ifs.ims.Save(ctx, s.Sid, s.Furl); err != nil {
-			log.Println("storage: infile: readUpdates: cannot Save in memory:", err.Error())
+		if err := ifs.apply(s); err != nil {
+			log.Println("storage: infile: readUpdates: cannot apply update in memory:", err.Error())
 			continue
 		}
 	}
@@ -239,3 +692,102 @@ func (ifs *InFile) readUpdates() error {
 	ifs.seek = fileInfo.Size()
 	return nil
 }
+
+func (ifs *InFile) apply(s shortedURL) error {
+	ctx := context.WithValue(context.Background(), UserCtxKey{}, fmt.Sprint(s.User))
+
+	switch {
+	case s.Op == opClicks && s.Clicks != nil:
+		clicks := *s.Clicks
+		clicks.Sid = s.Sid
+		return ifs.ims.SaveClicks(ctx, []Clicks{clicks})
+	case s.Op == opUpdate && s.Time != nil:
+		return ifs.ims.update(HistoryEntry{User: s.User, ChangedAt: *s.Time, NewURL: s.Furl}, s.Sid)
+	case s.Op == opJob && s.Job != nil:
+		ifs.ims.saveJob(*s.Job)
+		return nil
+	case s.Op == opKey && s.Key != nil:
+		ifs.ims.saveAPIKey(*s.Key)
+		return nil
+	case s.Op == opAccount && s.Account != nil:
+		// file is read again from start after compaction by another process
+		if saved, err := ifs.ims.GetAccount(ctx, s.Account.Login); err == nil && saved.User == s.Account.User {
+			return nil
+		}
+		return ifs.ims.SaveAccount(ctx, *s.Account)
+	case s.Op == opBind:
+		ifs.ims.bindUser(s.From, s.User)
+		return nil
+	case s.Op == opRelate:
+		ifs.ims.relate(ctx, s.User, s.Sid, s.Tags)
+		return nil
+	case s.Op == opTags:
+		return ifs.ims.setTags(s.User, s.Sid, s.Tags)
+	case s.Op == opBlock:
+		ifs.ims.block(s.Sid)
+		return nil
+	case s.Op == opRestore:
+		ifs.ims.restore(ctx, s.User, []ShortID{s.Sid}, time.Time{})
+		return nil
+	case s.Op != "":
+		return fmt.Errorf("unknown operation %q", s.Op)
+	case s.Deleted:
+		// deletion time is unknown for old records, so they cannot be restored
+		at := time.Time{}
+		if s.Time != nil {
+			at = *s.Time
+		}
+		ifs.ims.remove(s.User, []ShortID{s.Sid}, at)
+		return nil
+	}
+
+	err := ifs.ims.Save(ctx, s.Sid, s.Furl, s.meta())
+	if _, conflict := err.(ErrConflict); conflict {
+		// older files keep relations of already saved urls as saved url lines
+		ifs.ims.relate(ctx, s.User, s.Sid, s.Tags)
+		return nil
+	}
+
+	return err
+}
+
+func (ifs *InFile) eventsFilename() string {
+	return ifs.filename + ".events"
+}
+
+func (ifs *InFile) readEvents() error {
+	file, err := os.OpenFile(ifs.eventsFilename(), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	events := []ClickEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		ev := ClickEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			log.Println("storage: infile: readEvents: cannot Unmarshal ClickEvent:", err.Error())
+			continue
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return ifs.ims.SaveClickEvents(context.Background(), events)
+}
+
+func writeEvents(w io.Writer, events []ClickEvent) error {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+
+	for _, ev := range events {
+		if err := encoder.Encode(ev); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
@@ -2,20 +2,91 @@ package storage
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// maxURLClickEvents is how many latest click events are kept in memory per url
+const maxURLClickEvents = 100000
+
+// deletedURL is a tombstone of url, which keeps its ShortID taken
+type deletedURL struct {
+	furl FullURL
+	user User
+	// owners are all users the url was shared with, restore brings it back to each of them
+	owners []User
+	at     time.Time
+}
+
+func (d deletedURL) ownedBy(user User) bool {
+	for _, owner := range d.owners {
+		if owner == user {
+			return true
+		}
+	}
+
+	return false
+}
+
 type InMemory struct {
-	mutex   sync.RWMutex
-	shorts  map[User]SavedURLs
-	deleted map[ShortID]struct{}
-	users   int64
+	mutex    sync.RWMutex
+	shorts   map[User]SavedURLs
+	deleted  map[ShortID]deletedURL
+	urls     map[FullURL]ShortID
+	meta     map[ShortID]URLMeta
+	expiring map[ShortID]time.Time
+	stats    map[ShortID]*URLStats
+	events   map[ShortID][]ClickEvent
+	history  map[ShortID][]HistoryEntry
+	tags     map[User]*tagIndex
+	// created orders urls of every user by creation, so pages are cut without sorting all of them
+	created  map[User]createdIndex
+	jobs     map[JobID]DeleteJob
+	keys     map[APIKeyID]APIKey
+	hashes   map[string]APIKeyID
+	accounts map[string]Account
+	// registered maps users to their logins
+	registered map[User]string
+	users      int64
+	sequence   int64
+	gen        IDGenerator
+	// stop ends background sweeper on Close
+	stop chan struct{}
+	once sync.Once
 }
 
-func NewInMemory() Storage {
-	ims := InMemory{mutex: sync.RWMutex{}, shorts: map[User]SavedURLs{}, users: int64(0)}
+func NewInMemory(opts ...Option) Storage {
+	return newInMemory(newOptions(opts))
+}
+
+func newInMemory(o options) *InMemory {
+	ims := InMemory{
+		mutex:      sync.RWMutex{},
+		shorts:     map[User]SavedURLs{},
+		deleted:    map[ShortID]deletedURL{},
+		urls:       map[FullURL]ShortID{},
+		meta:       map[ShortID]URLMeta{},
+		expiring:   map[ShortID]time.Time{},
+		stats:      map[ShortID]*URLStats{},
+		events:     map[ShortID][]ClickEvent{},
+		history:    map[ShortID][]HistoryEntry{},
+		tags:       map[User]*tagIndex{},
+		created:    map[User]createdIndex{},
+		jobs:       map[JobID]DeleteJob{},
+		keys:       map[APIKeyID]APIKey{},
+		hashes:     map[string]APIKeyID{},
+		accounts:   map[string]Account{},
+		registered: map[User]string{},
+		users:      int64(0),
+		stop:       make(chan struct{}),
+	}
 	ims.shorts[DefaultUser] = SavedURLs{}
+	ims.gen = newIDGenerator(o.idStrategy, ims.nextSequence)
+
+	go ims.backgroundExpire()
+
 	return &ims
 }
 
@@ -32,10 +103,14 @@ func (ims *InMemory) Get(_ context.Context, sid ShortID) (FullURL, error) {
 		return DefaultFullURL, ErrNotFound{}
 	}
 
+	if ims.meta[sid].Expired(time.Now()) {
+		return DefaultFullURL, ErrExpired{}
+	}
+
 	return furl, nil
 }
 
-func (ims *InMemory) Save(ctx context.Context, sid ShortID, furl FullURL) error {
+func (ims *InMemory) Save(ctx context.Context, sid ShortID, furl FullURL, meta URLMeta) error {
 	user, err := GetUser(ctx)
 	if err != nil {
 		return err
@@ -44,33 +119,45 @@ func (ims *InMemory) Save(ctx context.Context, sid ShortID, furl FullURL) error
 	ims.mutex.Lock()
 	defer ims.mutex.Unlock()
 
-	if _, exist := ims.deleted[sid]; exist {
-		return ErrConflict{}
+	if saved, exist := ims.deleted[sid]; exist {
+		return checkCollision(saved.furl, furl)
 	}
 
 	// save short to defaultUser which used for Get() method
 	defaultShorts := ims.shorts[DefaultUser]
-	if _, exist := defaultShorts[sid]; exist {
-		return ErrConflict{}
+	if saved, exist := defaultShorts[sid]; exist {
+		// expired url is never the same as a new one
+		if ims.meta[sid].Expired(time.Now()) {
+			return ErrCollision{}
+		}
+		return checkCollision(saved, furl)
 	}
 	defaultShorts[sid] = furl
+	if _, exist := ims.urls[furl]; !exist {
+		ims.urls[furl] = sid
+	}
+	if meta.UpdatedAt.IsZero() {
+		meta.UpdatedAt = meta.CreatedAt
+	}
+	// tags are user's ones, url is tagged below
+	tags := meta.Tags
+	meta.Tags = nil
+	ims.meta[sid] = meta
+	if !meta.ExpiresAt.IsZero() {
+		ims.expiring[sid] = meta.ExpiresAt
+	}
 
 	// user's shorts
-	userShorts, exist := ims.shorts[user]
-	if !exist {
-		userShorts = SavedURLs{}
-		ims.shorts[user] = userShorts
-		go ims.AddUser(ctx, user)
-	}
-	userShorts[sid] = furl
+	ims.link(ctx, user, sid, furl)
+	ims.tag(user, sid, tags)
 
 	return nil
 }
 
-func (ims *InMemory) Put(ctx context.Context, furl FullURL) (ShortID, error) {
-	sid := Short(furl)
-
-	return sid, ims.Save(ctx, sid, furl)
+func (ims *InMemory) Put(ctx context.Context, furl FullURL, meta URLMeta) (ShortID, error) {
+	return putURL(ctx, ims.gen, furl, ims.lookup, func(sid ShortID) error {
+		return ims.Save(ctx, sid, furl, meta)
+	})
 }
 
 func (ims *InMemory) PutBatch(ctx context.Context, batch BatchRequest) (BatchResponse, error) {
@@ -79,55 +166,308 @@ func (ims *InMemory) PutBatch(ctx context.Context, batch BatchRequest) (BatchRes
 		return nil, err
 	}
 
+	result := BatchResponse{}
+	for corrid, burl := range batch {
+		sid, err := ims.Put(ctx, burl.URL, burl.Meta)
+
+		switch err.(type) {
+		case nil:
+		case ErrConflict:
+			if !ims.relate(ctx, user, sid, burl.Meta.Tags) {
+				//return result, ErrDeleted{}
+				continue
+			}
+		default:
+			return result, err
+		}
+
+		result[corrid] = sid
+	}
+
+	return result, nil
+}
+
+// relate adds already saved and not deleted ShortID to user's shorts, not empty tags replace user's ones
+func (ims *InMemory) relate(ctx context.Context, user User, sid ShortID, tags []string) bool {
 	ims.mutex.Lock()
 	defer ims.mutex.Unlock()
 
-	defaultShorts := ims.shorts[DefaultUser]
+	furl, exist := ims.shorts[DefaultUser][sid]
+	if !exist {
+		return false
+	}
+
+	ims.link(ctx, user, sid, furl)
+	ims.tag(user, sid, tags)
+
+	return true
+}
+
+// link adds url to user's shorts, mutex is expected to be locked
+func (ims *InMemory) link(ctx context.Context, user User, sid ShortID, furl FullURL) {
 	userShorts, exist := ims.shorts[user]
 	if !exist {
 		userShorts = SavedURLs{}
 		ims.shorts[user] = userShorts
 		go ims.AddUser(ctx, user)
 	}
+	if _, linked := userShorts[sid]; !linked && user != DefaultUser {
+		ims.created[user] = ims.created[user].add(ims.createdCursor(sid))
+	}
+	userShorts[sid] = furl
+}
 
-	result := BatchResponse{}
-	for corrid, furl := range batch {
-		sid := Short(furl)
+// unlink removes url from user's shorts, mutex is expected to be locked
+func (ims *InMemory) unlink(user User, sid ShortID) {
+	userShorts := ims.shorts[user]
+	if _, linked := userShorts[sid]; !linked {
+		return
+	}
+	delete(userShorts, sid)
+	if user != DefaultUser {
+		ims.created[user] = ims.created[user].remove(ims.createdCursor(sid))
+	}
+}
 
-		if _, exist := ims.deleted[sid]; exist {
-			//return result, ErrDeleted{}
-			continue
+func (ims *InMemory) createdCursor(sid ShortID) URLsCursor {
+	return UserURL{Sid: sid, Meta: ims.meta[sid]}.Cursor(SortByCreated)
+}
+
+func (ims *InMemory) lookup(furl FullURL) (ShortID, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	sid, exist := ims.urls[furl]
+	if !exist || ims.meta[sid].Expired(time.Now()) {
+		return DefaultShortID, ErrNotFound{}
+	}
+
+	return sid, nil
+}
+
+func (ims *InMemory) nextSequence(_ context.Context) (ShortID, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	// skip ids restored from file or saved by another strategy
+	for {
+		sid := ShortID(atomic.AddInt64(&ims.sequence, 1))
+
+		_, saved := ims.shorts[DefaultUser][sid]
+		_, deleted := ims.deleted[sid]
+		if !saved && !deleted {
+			return sid, nil
 		}
+	}
+}
 
-		if _, exist := defaultShorts[sid]; exist {
-			//return result, ErrConflict{}
-			continue
+func (ims *InMemory) GetURLs(ctx context.Context, query URLsQuery) ([]UserURL, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	userShorts, userTags := ims.shorts[user], ims.tags[user]
+	if userTags == nil {
+		userTags = newTagIndex()
+	}
+	userURL := func(sid ShortID) (UserURL, bool) {
+		furl, exist := userShorts[sid]
+		if !exist {
+			return UserURL{}, false
+		}
+		u := UserURL{Sid: sid, URL: furl, Meta: ims.meta[sid], Tags: userTags.byURL[sid]}
+		if stats, exist := ims.stats[sid]; exist {
+			u.Clicks = stats.Clicks
 		}
+		return u, true
+	}
 
-		defaultShorts[sid] = furl
-		userShorts[sid] = furl
-		result[corrid] = sid
+	result := []UserURL{}
+	if query.Sort != SortByClicks && query.Tag == "" {
+		// page by creation is read from index up to its limit
+		ims.created[user].walk(query, func(sid ShortID) bool {
+			if u, exist := userURL(sid); exist && query.match(u) {
+				result = append(result, u)
+			}
+			return query.Limit <= 0 || len(result) < query.Limit
+		})
+	} else {
+		// tagged urls are taken from index instead of all user's urls,
+		// clicks change on every flush, so urls are ordered by them here
+		sids := make([]ShortID, 0, len(userShorts))
+		if query.Tag != "" {
+			for sid := range userTags.byTag[query.Tag] {
+				sids = append(sids, sid)
+			}
+		} else {
+			for sid := range userShorts {
+				sids = append(sids, sid)
+			}
+		}
+
+		urls := make([]UserURL, 0, len(sids))
+		for _, sid := range sids {
+			if u, exist := userURL(sid); exist {
+				urls = append(urls, u)
+			}
+		}
+		result = query.page(urls)
+	}
+
+	if len(result) == 0 {
+		return nil, ErrNotFound{}
 	}
 
 	return result, nil
 }
 
-func (ims *InMemory) GetURLs(ctx context.Context) (SavedURLs, error) {
+func (ims *InMemory) UpdateURL(ctx context.Context, sid ShortID, furl FullURL) error {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := ims.checkCreator(user, sid); err != nil {
+		return err
+	}
+
+	return ims.update(HistoryEntry{User: user, ChangedAt: time.Now(), NewURL: furl}, sid)
+}
+
+// checkCreator rejects changes of url shared with user, so it keeps pointing where its creator wants
+func (ims *InMemory) checkCreator(user User, sid ShortID) error {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	if _, exist := ims.shorts[user][sid]; exist && ims.meta[sid].Creator != user {
+		return ErrNotCreator{}
+	}
+
+	return nil
+}
+
+// update changes destination of user's url and records the change
+func (ims *InMemory) update(entry HistoryEntry, sid ShortID) error {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	oldURL, exist := ims.shorts[entry.User][sid]
+	if !exist || entry.User == DefaultUser {
+		return ErrNotFound{}
+	}
+	if ims.meta[sid].Expired(entry.ChangedAt) {
+		return ErrExpired{}
+	}
+	if oldURL == entry.NewURL {
+		return nil
+	}
+
+	for _, userShorts := range ims.shorts {
+		if _, exist := userShorts[sid]; exist {
+			userShorts[sid] = entry.NewURL
+		}
+	}
+
+	if ims.urls[oldURL] == sid {
+		delete(ims.urls, oldURL)
+	}
+	if _, exist := ims.urls[entry.NewURL]; !exist {
+		ims.urls[entry.NewURL] = sid
+	}
+
+	meta := ims.meta[sid]
+	meta.UpdatedAt = entry.ChangedAt
+	ims.meta[sid] = meta
+
+	entry.OldURL = oldURL
+	ims.history[sid] = append(ims.history[sid], entry)
+
+	return nil
+}
+
+func (ims *InMemory) GetHistory(ctx context.Context, sid ShortID) ([]HistoryEntry, error) {
 	user, err := GetUser(ctx)
 	if err != nil {
 		return nil, err
-	} else if user == DefaultUser {
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	if _, exist := ims.shorts[user][sid]; !exist || user == DefaultUser {
 		return nil, ErrNotFound{}
 	}
 
+	return append([]HistoryEntry{}, ims.history[sid]...), nil
+}
+
+func (ims *InMemory) SetTags(ctx context.Context, sid ShortID, tags []string) error {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	return ims.setTags(user, sid, tags)
+}
+
+func (ims *InMemory) setTags(user User, sid ShortID, tags []string) error {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	if _, exist := ims.shorts[user][sid]; !exist || user == DefaultUser {
+		return ErrNotFound{}
+	}
+
+	userTags, exist := ims.tags[user]
+	if !exist {
+		userTags = newTagIndex()
+		ims.tags[user] = userTags
+	}
+	userTags.set(sid, tags)
+
+	return nil
+}
+
+// tag sets not empty tags of user's url, mutex is expected to be locked
+func (ims *InMemory) tag(user User, sid ShortID, tags []string) {
+	if len(tags) == 0 || user == DefaultUser {
+		return
+	}
+
+	userTags, exist := ims.tags[user]
+	if !exist {
+		userTags = newTagIndex()
+		ims.tags[user] = userTags
+	}
+	userTags.set(sid, tags)
+}
+
+func (ims *InMemory) GetTags(ctx context.Context) ([]TagCount, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	ims.mutex.RLock()
 	defer ims.mutex.RUnlock()
 
-	result := SavedURLs{}
-	for sid, furl := range ims.shorts[user] {
-		result[sid] = furl
+	userTags, exist := ims.tags[user]
+	if !exist || user == DefaultUser {
+		return nil, ErrNotFound{}
 	}
 
+	// tags of deleted and expired urls are kept, but not counted
+	userShorts := ims.shorts[user]
+	result := userTags.count(func(sid ShortID) bool {
+		_, exist := userShorts[sid]
+		return exist
+	})
 	if len(result) == 0 {
 		return nil, ErrNotFound{}
 	}
@@ -135,25 +475,275 @@ func (ims *InMemory) GetURLs(ctx context.Context) (SavedURLs, error) {
 	return result, nil
 }
 
-func (ims *InMemory) DeleteURLs(ctx context.Context, sids []ShortID) error {
-	if _, err := GetUser(ctx); err != nil {
-		return err
+func (ims *InMemory) DeleteURLs(ctx context.Context, sids []ShortID) (JobID, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return "", err
 	}
 
+	job := newDeleteJob(user, sids, time.Now())
+	ims.saveJob(job)
+
 	go func() {
-		_ = ims.AsyncDeleteURLs(ctx, sids)
+		deleted := ims.remove(user, job.Requested, time.Now())
+		job.finish(deleted, time.Now())
+		ims.saveJob(job)
 	}()
 
-	return nil
+	return job.ID, nil
 }
 
-func (ims *InMemory) AsyncDeleteURLs(ctx context.Context, sids []ShortID) []ShortID {
-	result := []ShortID{}
+func (ims *InMemory) GetDeleteJob(ctx context.Context, id JobID) (DeleteJob, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return DeleteJob{}, err
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	job, exist := ims.jobs[id]
+	if !exist || job.User != user {
+		return DeleteJob{}, ErrNotFound{}
+	}
 
+	return job, nil
+}
+
+// saveJob keeps the latest state of job, done job is never replaced by pending one
+func (ims *InMemory) saveJob(job DeleteJob) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	if saved, exist := ims.jobs[job.ID]; exist && saved.Done() {
+		return
+	}
+	ims.jobs[job.ID] = job
+}
+
+func (ims *InMemory) hasJob(id JobID) bool {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	_, exist := ims.jobs[id]
+	return exist
+}
+
+func (ims *InMemory) SaveAPIKey(ctx context.Context, key APIKey) (APIKeyID, error) {
 	user, err := GetUser(ctx)
 	if err != nil {
-		return result
+		return "", err
+	} else if user == DefaultUser {
+		return "", ErrNotFound{}
+	}
+
+	key.ID, key.User = newAPIKeyID(), user
+	ims.saveAPIKey(key)
+
+	return key.ID, nil
+}
+
+// saveAPIKey keeps the latest state of key, revoked key is never replaced by active one
+func (ims *InMemory) saveAPIKey(key APIKey) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	if saved, exist := ims.keys[key.ID]; exist && saved.Revoked() {
+		return
+	}
+	ims.keys[key.ID] = key
+	ims.hashes[key.Hash] = key.ID
+}
+
+func (ims *InMemory) GetAPIKeys(ctx context.Context) ([]APIKey, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := []APIKey{}
+	for _, key := range ims.keys {
+		if key.User == user && !key.Revoked() {
+			result = append(result, key)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+func (ims *InMemory) RevokeAPIKey(ctx context.Context, id APIKeyID) error {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return err
+	} else if user == DefaultUser {
+		return ErrNotFound{}
+	}
+
+	_, err = ims.revokeAPIKey(user, id, time.Now())
+	return err
+}
+
+func (ims *InMemory) revokeAPIKey(user User, id APIKeyID, at time.Time) (APIKey, error) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	key, exist := ims.keys[id]
+	if !exist || key.User != user || key.Revoked() {
+		return APIKey{}, ErrNotFound{}
+	}
+
+	key.RevokedAt = at
+	ims.keys[id] = key
+
+	return key, nil
+}
+
+func (ims *InMemory) GetAPIKey(_ context.Context, hash string) (APIKey, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	key, exist := ims.keys[ims.hashes[hash]]
+	if !exist || key.Revoked() {
+		return APIKey{}, ErrNotFound{}
+	}
+
+	return key, nil
+}
+
+func (ims *InMemory) hasAPIKey(id APIKeyID) bool {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	_, exist := ims.keys[id]
+	return exist
+}
+
+func (ims *InMemory) SaveAccount(_ context.Context, account Account) error {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	if _, exist := ims.accounts[account.Login]; exist {
+		return ErrConflict{}
 	}
+	if _, exist := ims.registered[account.User]; exist {
+		return ErrConflict{}
+	}
+
+	ims.accounts[account.Login] = account
+	ims.registered[account.User] = account.Login
+
+	return nil
+}
+
+func (ims *InMemory) GetAccount(_ context.Context, login string) (Account, error) {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	account, exist := ims.accounts[login]
+	if !exist {
+		return Account{}, ErrNotFound{}
+	}
+
+	return account, nil
+}
+
+func (ims *InMemory) BindUser(_ context.Context, from, to User) error {
+	ims.bindUser(from, to)
+	return nil
+}
+
+// bindUser returns whether anything of user from is moved to user to
+func (ims *InMemory) bindUser(from, to User) bool {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	if from == to || from == DefaultUser || to == DefaultUser {
+		return false
+	}
+	if _, registered := ims.registered[from]; registered {
+		return false
+	}
+
+	for sid, furl := range ims.shorts[from] {
+		ims.link(context.Background(), to, sid, furl)
+	}
+	delete(ims.shorts, from)
+	delete(ims.created, from)
+
+	for sid, deleted := range ims.deleted {
+		if deleted.user == from {
+			deleted.user = to
+		}
+		for i, owner := range deleted.owners {
+			if owner == from {
+				deleted.owners[i] = to
+			}
+		}
+		ims.deleted[sid] = deleted
+	}
+
+	for sid, meta := range ims.meta {
+		if meta.Creator == from {
+			meta.Creator = to
+			ims.meta[sid] = meta
+		}
+	}
+
+	for _, entries := range ims.history {
+		for i := range entries {
+			if entries[i].User == from {
+				entries[i].User = to
+			}
+		}
+	}
+
+	if fromTags, exist := ims.tags[from]; exist {
+		toTags, exist := ims.tags[to]
+		if !exist {
+			toTags = newTagIndex()
+			ims.tags[to] = toTags
+		}
+		// tags of user to win for urls tagged by both users
+		for sid, tags := range fromTags.byURL {
+			if _, tagged := toTags.byURL[sid]; !tagged {
+				toTags.set(sid, tags)
+			}
+		}
+		delete(ims.tags, from)
+	}
+
+	for id, key := range ims.keys {
+		if key.User == from {
+			key.User = to
+			ims.keys[id] = key
+		}
+	}
+
+	for id, job := range ims.jobs {
+		if job.User == from {
+			job.User = to
+			ims.jobs[id] = job
+		}
+	}
+
+	return true
+}
+
+// remove marks user's urls as deleted at the given time
+func (ims *InMemory) remove(user User, sids []ShortID, at time.Time) []ShortID {
+	result := []ShortID{}
 
 	ims.mutex.Lock()
 	defer ims.mutex.Unlock()
@@ -169,15 +759,311 @@ func (ims *InMemory) AsyncDeleteURLs(ctx context.Context, sids []ShortID) []Shor
 		if _, exist := userShorts[sid]; !exist {
 			continue
 		}
-		delete(userShorts, sid)
+		furl := userShorts[sid]
+		// url shared with user is unlinked from user only, so it keeps working for its creator.
+		// Urls without known creator are deleted by any of their owners
+		if creator := ims.meta[sid].Creator; creator != DefaultUser && creator != user {
+			ims.unlink(user, sid)
+			if userTags, exist := ims.tags[user]; exist {
+				userTags.remove(sid)
+			}
+			result = append(result, sid)
+			continue
+		}
+		// url is deleted for every user it was shared with, as in database
+		owners := []User{}
+		for owner, ownerShorts := range ims.shorts {
+			if _, exist := ownerShorts[sid]; exist && owner != DefaultUser {
+				owners = append(owners, owner)
+				ims.unlink(owner, sid)
+			}
+		}
+		deleted[sid] = deletedURL{furl: furl, user: user, owners: owners, at: at}
 		delete(defaultShorts, sid)
-		deleted[sid] = struct{}{}
+		if ims.urls[furl] == sid {
+			delete(ims.urls, furl)
+		}
 		result = append(result, sid)
 	}
 
 	return result
 }
 
+func (ims *InMemory) GetDeletedURLs(ctx context.Context, since time.Time) ([]DeletedURL, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := []DeletedURL{}
+	for sid, deleted := range ims.deleted {
+		if deleted.ownedBy(user) && !deleted.at.Before(since) {
+			result = append(result, DeletedURL{Sid: sid, URL: deleted.furl, DeletedAt: deleted.at})
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, ErrNotFound{}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DeletedAt.After(result[j].DeletedAt)
+	})
+
+	return result, nil
+}
+
+func (ims *InMemory) RestoreURLs(ctx context.Context, sids []ShortID, since time.Time) (SavedURLs, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	} else if user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	result := ims.restore(ctx, user, sids, since)
+	if len(result) == 0 {
+		return nil, ErrNotFound{}
+	}
+
+	return result, nil
+}
+
+// restore brings back urls of user deleted after since to all of their owners
+func (ims *InMemory) restore(ctx context.Context, user User, sids []ShortID, since time.Time) SavedURLs {
+	result := SavedURLs{}
+
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	for _, sid := range sids {
+		deleted, exist := ims.deleted[sid]
+		if !exist || !deleted.ownedBy(user) || deleted.at.Before(since) {
+			continue
+		}
+
+		delete(ims.deleted, sid)
+		ims.shorts[DefaultUser][sid] = deleted.furl
+		if _, exist := ims.urls[deleted.furl]; !exist {
+			ims.urls[deleted.furl] = sid
+		}
+
+		for _, owner := range deleted.owners {
+			ims.link(ctx, owner, sid, deleted.furl)
+		}
+
+		result[sid] = deleted.furl
+	}
+
+	return result
+}
+
+func (ims *InMemory) PurgeDeleted(_ context.Context, before time.Time, keepBlocked bool) (PurgeStats, error) {
+	stats, _ := ims.purge(before, keepBlocked)
+
+	return stats, nil
+}
+
+// purge removes everything about urls deleted before the given time and returns their ShortIDs
+func (ims *InMemory) purge(before time.Time, keepBlocked bool) (PurgeStats, []ShortID) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	for id, job := range ims.jobs {
+		if job.Done() && job.DoneAt.Before(before) {
+			delete(ims.jobs, id)
+		}
+	}
+	for id, key := range ims.keys {
+		if key.Revoked() && key.RevokedAt.Before(before) {
+			delete(ims.hashes, key.Hash)
+			delete(ims.keys, id)
+		}
+	}
+
+	// values tell whether ShortID is already purged and blocked
+	candidates := map[ShortID]bool{}
+	for sid, deleted := range ims.deleted {
+		// DefaultUser marks already purged and blocked ShortID
+		blocked := deleted.user == DefaultUser
+		if !deleted.at.Before(before) || (blocked && keepBlocked) {
+			continue
+		}
+		candidates[sid] = blocked
+	}
+	// expired urls are purged as if they were deleted on expiry
+	for sid, meta := range ims.meta {
+		if _, deleted := ims.deleted[sid]; !deleted && !meta.ExpiresAt.IsZero() && meta.ExpiresAt.Before(before) {
+			candidates[sid] = false
+		}
+	}
+
+	stats := PurgeStats{}
+	purged := []ShortID{}
+	for sid, blocked := range candidates {
+		// dangling relations of users which shared the url
+		stats.Relations += int64(len(ims.deleted[sid].owners))
+		for user, userShorts := range ims.shorts {
+			if _, exist := userShorts[sid]; exist && user != DefaultUser {
+				ims.unlink(user, sid)
+				stats.Relations++
+			}
+		}
+		if furl, exist := ims.shorts[DefaultUser][sid]; exist {
+			delete(ims.shorts[DefaultUser], sid)
+			if ims.urls[furl] == sid {
+				delete(ims.urls, furl)
+			}
+		}
+
+		delete(ims.meta, sid)
+		delete(ims.expiring, sid)
+		delete(ims.stats, sid)
+		delete(ims.events, sid)
+		delete(ims.history, sid)
+		for _, userTags := range ims.tags {
+			userTags.remove(sid)
+		}
+
+		if keepBlocked {
+			ims.deleted[sid] = deletedURL{user: DefaultUser}
+		} else {
+			delete(ims.deleted, sid)
+		}
+
+		if !blocked {
+			stats.URLs++
+		}
+		purged = append(purged, sid)
+	}
+
+	return stats, purged
+}
+
+// block keeps ShortID of purged url taken
+func (ims *InMemory) block(sid ShortID) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	ims.deleted[sid] = deletedURL{user: DefaultUser}
+}
+
+func (ims *InMemory) SaveClicks(_ context.Context, clicks []Clicks) error {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	for _, c := range clicks {
+		stats, exist := ims.stats[c.Sid]
+		if !exist {
+			stats = &URLStats{}
+			ims.stats[c.Sid] = stats
+		}
+		stats.Add(c)
+	}
+
+	return nil
+}
+
+func (ims *InMemory) GetStats(ctx context.Context, sid ShortID) (URLStats, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return URLStats{}, err
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	if _, exist := ims.shorts[user][sid]; !exist || user == DefaultUser {
+		return URLStats{}, ErrNotFound{}
+	}
+
+	result := URLStats{Daily: []DailyClicks{}}
+	if stats, exist := ims.stats[sid]; exist {
+		result = *stats
+		result.Daily = append([]DailyClicks{}, stats.Daily...)
+	}
+	sort.Slice(result.Daily, func(i, j int) bool {
+		return result.Daily[i].Day.Before(result.Daily[j].Day)
+	})
+
+	return result, nil
+}
+
+func (ims *InMemory) SaveClickEvents(_ context.Context, events []ClickEvent) error {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	for _, ev := range events {
+		kept := append(ims.events[ev.Sid], ev)
+		// the oldest events go first, reallocation drops them from memory
+		if len(kept) > maxURLClickEvents {
+			kept = kept[len(kept)-maxURLClickEvents:]
+		}
+		ims.events[ev.Sid] = kept
+	}
+
+	return nil
+}
+
+func (ims *InMemory) GetAnalytics(ctx context.Context, query AnalyticsQuery) ([]AnalyticsBucket, error) {
+	user, err := GetUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	if _, exist := ims.shorts[user][query.Sid]; !exist || user == DefaultUser {
+		return nil, ErrNotFound{}
+	}
+
+	return query.aggregate(ims.events[query.Sid]), nil
+}
+
+func (ims *InMemory) PurgeClickEvents(_ context.Context, before time.Time) (int64, error) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	purged := int64(0)
+	for sid, events := range ims.events {
+		kept := events[:0]
+		for _, ev := range events {
+			if ev.Time.Before(before) {
+				purged += 1
+				continue
+			}
+			kept = append(kept, ev)
+		}
+
+		if len(kept) == 0 {
+			delete(ims.events, sid)
+			continue
+		}
+		ims.events[sid] = kept
+	}
+
+	return purged, nil
+}
+
+// clickEvents returns copy of all events
+func (ims *InMemory) clickEvents() []ClickEvent {
+	ims.mutex.RLock()
+	defer ims.mutex.RUnlock()
+
+	result := []ClickEvent{}
+	for _, events := range ims.events {
+		result = append(result, events...)
+	}
+
+	return result
+}
+
 func (ims *InMemory) NewUser(_ context.Context) (User, error) {
 	n := atomic.AddInt64(&ims.users, int64(1))
 	return User(n), nil
@@ -198,3 +1084,56 @@ func (ims *InMemory) AddUser(_ context.Context, user User) {
 func (ims *InMemory) Ping(_ context.Context) bool {
 	return true
 }
+
+func (ims *InMemory) PendingMigrations(_ context.Context) []string {
+	return []string{}
+}
+
+// Close stops background sweeper
+func (ims *InMemory) Close(_ context.Context) error {
+	ims.once.Do(func() {
+		close(ims.stop)
+	})
+
+	return nil
+}
+
+func (ims *InMemory) backgroundExpire() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			ims.expire(now)
+		case <-ims.stop:
+			return
+		}
+	}
+}
+
+// expire hides expired urls from users, but keeps them for Get() to answer ErrExpired
+// until they are purged like deleted ones
+func (ims *InMemory) expire(now time.Time) {
+	ims.mutex.Lock()
+	defer ims.mutex.Unlock()
+
+	for sid, expiresAt := range ims.expiring {
+		if now.Before(expiresAt) {
+			continue
+		}
+
+		delete(ims.expiring, sid)
+		for user := range ims.shorts {
+			if user == DefaultUser {
+				continue
+			}
+			ims.unlink(user, sid)
+		}
+
+		furl := ims.shorts[DefaultUser][sid]
+		if ims.urls[furl] == sid {
+			delete(ims.urls, furl)
+		}
+	}
+}
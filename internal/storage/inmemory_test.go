@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemory_PutCollision(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+
+	furl := FullURL("https://example.com/collided")
+	other := FullURL("https://example.com/other")
+
+	// occupy first candidate of furl by another url as if fnv collided
+	assert.Nil(t, ims.Save(ctx, Short(furl), other, URLMeta{}))
+	assert.IsType(t, ErrConflict{}, ims.Save(ctx, Short(furl), other, URLMeta{}))
+	assert.IsType(t, ErrCollision{}, ims.Save(ctx, Short(furl), furl, URLMeta{}))
+
+	sid, err := ims.Put(ctx, furl, URLMeta{})
+	assert.Nil(t, err)
+	assert.Equal(t, SaltedShort(furl, 1), sid)
+
+	again, err := ims.Put(ctx, furl, URLMeta{})
+	assert.IsType(t, ErrConflict{}, err)
+	assert.Equal(t, sid, again)
+
+	saved, err := ims.Get(ctx, Short(furl))
+	assert.Nil(t, err)
+	assert.Equal(t, other, saved)
+
+	fresh := FullURL("https://example.com/fresh")
+	batch, err := ims.PutBatch(ctx, BatchRequest{"1": {URL: furl}, "2": {URL: fresh}})
+	assert.Nil(t, err)
+	assert.Equal(t, BatchResponse{"1": sid, "2": Short(fresh)}, batch)
+}
+
+func TestInMemory_IDStrategies(t *testing.T) {
+	ctx := PutUser(context.Background(), User(1))
+	furl := FullURL("https://example.com/strategy")
+
+	sequential := NewInMemory(WithIDStrategy(IDStrategySequential))
+	defer sequential.Close(context.Background())
+	assert.Nil(t, sequential.Save(ctx, ShortID(1), FullURL("https://example.com/taken"), URLMeta{}))
+
+	sid, err := sequential.Put(ctx, furl, URLMeta{})
+	assert.Nil(t, err)
+	assert.Equal(t, ShortID(2), sid)
+
+	again, err := sequential.Put(ctx, furl, URLMeta{})
+	assert.IsType(t, ErrConflict{}, err)
+	assert.Equal(t, sid, again)
+
+	// saved url is found by itself, not by the id its hash would give
+	taken, err := sequential.Put(ctx, FullURL("https://example.com/taken"), URLMeta{})
+	assert.IsType(t, ErrConflict{}, err)
+	assert.Equal(t, ShortID(1), taken)
+
+	random := NewInMemory(WithIDStrategy(IDStrategyRandom))
+	defer random.Close(context.Background())
+	first, err := random.Put(ctx, furl, URLMeta{})
+	assert.Nil(t, err)
+	second, err := random.Put(ctx, furl+"/other", URLMeta{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	assert.NotEqual(t, Short(furl), first)
+}
+
+func TestInMemory_Expiration(t *testing.T) {
+	ims := newInMemory(newOptions(nil))
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+	furl := FullURL("https://example.com/temporary")
+	now := time.Now()
+
+	sid, err := ims.Put(ctx, furl, URLMeta{ExpiresAt: now.Add(time.Hour)})
+	assert.Nil(t, err)
+
+	_, err = ims.Get(ctx, sid)
+	assert.Nil(t, err)
+
+	ims.expire(now.Add(2 * time.Hour))
+	_, err = ims.GetURLs(ctx, URLsQuery{})
+	assert.IsType(t, ErrNotFound{}, err)
+
+	ims.meta[sid] = URLMeta{ExpiresAt: now}
+	_, err = ims.Get(ctx, sid)
+	assert.IsType(t, ErrExpired{}, err)
+
+	// expired url does not block shortening the same url again
+	renewed, err := ims.Put(ctx, furl, URLMeta{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, sid, renewed)
+
+	// expired url is purged as deleted one
+	stats, purged := ims.purge(now.Add(time.Second), false)
+	assert.Equal(t, []ShortID{sid}, purged)
+	assert.Equal(t, int64(1), stats.URLs)
+	_, err = ims.Get(ctx, sid)
+	assert.IsType(t, ErrNotFound{}, err)
+	saved, err := ims.Get(ctx, renewed)
+	assert.Nil(t, err)
+	assert.Equal(t, furl, saved)
+}
+
+func TestInMemory_Restore(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	owner := PutUser(context.Background(), User(1))
+	stranger := PutUser(context.Background(), User(2))
+	furl := FullURL("https://example.com/restore")
+
+	sid, err := ims.Put(owner, furl, URLMeta{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ShortID{sid}, deleteURLs(t, ims, owner, []ShortID{sid}))
+
+	_, err = ims.Get(owner, sid)
+	assert.IsType(t, ErrDeleted{}, err)
+
+	deleted, err := ims.GetDeletedURLs(owner, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	if assert.Len(t, deleted, 1) {
+		assert.Equal(t, furl, deleted[0].URL)
+	}
+
+	// out of grace window
+	_, err = ims.RestoreURLs(owner, []ShortID{sid}, time.Now().Add(time.Hour))
+	assert.IsType(t, ErrNotFound{}, err)
+
+	_, err = ims.RestoreURLs(stranger, []ShortID{sid}, time.Now().Add(-time.Hour))
+	assert.IsType(t, ErrNotFound{}, err)
+
+	restored, err := ims.RestoreURLs(owner, []ShortID{sid}, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, SavedURLs{sid: furl}, restored)
+
+	saved, err := ims.Get(owner, sid)
+	assert.Nil(t, err)
+	assert.Equal(t, furl, saved)
+
+	again, err := ims.Put(owner, furl, URLMeta{})
+	assert.IsType(t, ErrConflict{}, err)
+	assert.Equal(t, sid, again)
+}
+
+func TestInMemory_RestoreShared(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	owner := PutUser(context.Background(), User(1))
+	coowner := PutUser(context.Background(), User(2))
+	furl := FullURL("https://example.com/restore-shared")
+
+	sid, err := ims.Put(owner, furl, URLMeta{Creator: User(1)})
+	assert.Nil(t, err)
+	_, err = ims.PutBatch(coowner, BatchRequest{"1": {URL: furl}})
+	assert.Nil(t, err)
+
+	// deletion by co-owner hides url from co-owner only
+	assert.Equal(t, []ShortID{sid}, deleteURLs(t, ims, coowner, []ShortID{sid}))
+	_, err = ims.GetURLs(coowner, URLsQuery{})
+	assert.IsType(t, ErrNotFound{}, err)
+	_, err = ims.GetDeletedURLs(coowner, time.Now().Add(-time.Hour))
+	assert.IsType(t, ErrNotFound{}, err)
+	saved, err := ims.Get(owner, sid)
+	assert.Nil(t, err)
+	assert.Equal(t, furl, saved)
+	_, err = ims.PutBatch(coowner, BatchRequest{"1": {URL: furl}})
+	assert.Nil(t, err)
+
+	// deletion by creator hides url from everyone it was shared with
+	assert.Equal(t, []ShortID{sid}, deleteURLs(t, ims, owner, []ShortID{sid}))
+	_, err = ims.GetURLs(coowner, URLsQuery{})
+	assert.IsType(t, ErrNotFound{}, err)
+
+	deleted, err := ims.GetDeletedURLs(coowner, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Len(t, deleted, 1)
+
+	// restore by any of owners brings url back to all of them
+	_, err = ims.RestoreURLs(coowner, []ShortID{sid}, time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	for _, ctx := range []context.Context{owner, coowner} {
+		urls, err := ims.GetURLs(ctx, URLsQuery{})
+		assert.Nil(t, err)
+		if assert.Len(t, urls, 1) {
+			assert.Equal(t, sid, urls[0].Sid)
+		}
+	}
+}
+
+func TestInMemory_PurgeDeleted(t *testing.T) {
+	ctx := PutUser(context.Background(), User(1))
+	furl := FullURL("https://example.com/purge")
+
+	for _, keepBlocked := range []bool{true, false} {
+		ims := NewInMemory()
+		defer ims.Close(context.Background())
+		sid, err := ims.Put(ctx, furl, URLMeta{})
+		assert.Nil(t, err)
+		deleteURLs(t, ims, ctx, []ShortID{sid})
+
+		// still within the given window
+		stats, err := ims.PurgeDeleted(ctx, time.Now().Add(-time.Hour), keepBlocked)
+		assert.Nil(t, err)
+		assert.Equal(t, PurgeStats{}, stats)
+
+		stats, err = ims.PurgeDeleted(ctx, time.Now().Add(time.Hour), keepBlocked)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), stats.URLs)
+
+		_, err = ims.RestoreURLs(ctx, []ShortID{sid}, time.Time{})
+		assert.IsType(t, ErrNotFound{}, err)
+
+		_, err = ims.Get(ctx, sid)
+		if keepBlocked {
+			assert.IsType(t, ErrDeleted{}, err)
+			assert.IsType(t, ErrCollision{}, ims.Save(ctx, sid, furl, URLMeta{}))
+		} else {
+			assert.IsType(t, ErrNotFound{}, err)
+			assert.Nil(t, ims.Save(ctx, sid, furl, URLMeta{}))
+		}
+	}
+}
+
+func TestInMemory_PurgeBlocked(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+	furl := FullURL("https://example.com/purge-blocked")
+
+	sid, err := ims.Put(ctx, furl, URLMeta{})
+	assert.Nil(t, err)
+	deleteURLs(t, ims, ctx, []ShortID{sid})
+
+	stats, err := ims.PurgeDeleted(ctx, time.Now().Add(time.Hour), true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), stats.URLs)
+
+	// blocked url is released, but it is not counted twice
+	stats, err = ims.PurgeDeleted(ctx, time.Now().Add(time.Hour), false)
+	assert.Nil(t, err)
+	assert.Equal(t, PurgeStats{}, stats)
+	_, err = ims.Get(ctx, sid)
+	assert.IsType(t, ErrNotFound{}, err)
+	assert.Nil(t, ims.Save(ctx, sid, furl, URLMeta{}))
+}
+
+func TestInMemory_GetURLs(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+	now := time.Now()
+
+	sids := []ShortID{}
+	for i, furl := range []FullURL{"https://example.com/a", "https://example.org/b", "https://example.com/c"} {
+		sid, err := ims.Put(ctx, furl, URLMeta{CreatedAt: now.Add(time.Duration(i) * time.Second)})
+		assert.Nil(t, err)
+		sids = append(sids, sid)
+	}
+
+	first, err := ims.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Limit: 2})
+	assert.Nil(t, err)
+	if assert.Len(t, first, 2) {
+		assert.Equal(t, sids[0], first[0].Sid)
+		assert.Equal(t, sids[1], first[1].Sid)
+	}
+
+	cursor := first[1].Cursor(SortByCreated)
+	second, err := ims.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Limit: 2, After: &cursor})
+	assert.Nil(t, err)
+	if assert.Len(t, second, 1) {
+		assert.Equal(t, sids[2], second[0].Sid)
+	}
+
+	filtered, err := ims.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Desc: true, Contains: "example.com"})
+	assert.Nil(t, err)
+	if assert.Len(t, filtered, 2) {
+		assert.Equal(t, sids[2], filtered[0].Sid)
+		assert.Equal(t, sids[0], filtered[1].Sid)
+	}
+
+	cursor = filtered[0].Cursor(SortByCreated)
+	previous, err := ims.GetURLs(ctx, URLsQuery{Sort: SortByCreated, Desc: true, Limit: 1, After: &cursor})
+	assert.Nil(t, err)
+	if assert.Len(t, previous, 1) {
+		assert.Equal(t, sids[1], previous[0].Sid)
+	}
+
+	assert.Nil(t, ims.SaveClicks(ctx, []Clicks{{Sid: sids[1], Count: 5}, {Sid: sids[0], Count: 1}}))
+	clicked, err := ims.GetURLs(ctx, URLsQuery{Sort: SortByClicks, Desc: true, Limit: 2})
+	assert.Nil(t, err)
+	if assert.Len(t, clicked, 2) {
+		assert.Equal(t, sids[1], clicked[0].Sid)
+		assert.Equal(t, sids[0], clicked[1].Sid)
+	}
+}
+
+func TestInMemory_Metadata(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+	createdAt := time.Now().Add(-time.Hour)
+
+	sid, err := ims.Put(ctx, "https://example.com/metadata", URLMeta{CreatedAt: createdAt, Creator: User(1), Title: "title", Note: "note"})
+	assert.Nil(t, err)
+
+	urls, err := ims.GetURLs(ctx, URLsQuery{})
+	assert.Nil(t, err)
+	if assert.Len(t, urls, 1) {
+		assert.Equal(t, createdAt, urls[0].Meta.UpdatedAt)
+		assert.Equal(t, User(1), urls[0].Meta.Creator)
+		assert.Equal(t, "title", urls[0].Meta.Title)
+		assert.Equal(t, "note", urls[0].Meta.Note)
+	}
+
+	assert.Nil(t, ims.UpdateURL(ctx, sid, "https://example.org/metadata"))
+	urls, err = ims.GetURLs(ctx, URLsQuery{})
+	assert.Nil(t, err)
+	if assert.Len(t, urls, 1) {
+		assert.Equal(t, createdAt, urls[0].Meta.CreatedAt)
+		assert.True(t, urls[0].Meta.UpdatedAt.After(createdAt))
+	}
+}
+
+func TestInMemory_APIKeys(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+	otherCtx := PutUser(context.Background(), User(2))
+
+	id, err := ims.SaveAPIKey(ctx, APIKey{Name: "ci", Hash: "hash", Scopes: []string{"read"}, CreatedAt: time.Now()})
+	assert.Nil(t, err)
+
+	key, err := ims.GetAPIKey(ctx, "hash")
+	assert.Nil(t, err)
+	assert.Equal(t, id, key.ID)
+	assert.Equal(t, User(1), key.User)
+
+	keys, err := ims.GetAPIKeys(otherCtx)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	assert.IsType(t, ErrNotFound{}, ims.RevokeAPIKey(otherCtx, id))
+	assert.Nil(t, ims.RevokeAPIKey(ctx, id))
+	assert.IsType(t, ErrNotFound{}, ims.RevokeAPIKey(ctx, id))
+
+	_, err = ims.GetAPIKey(ctx, "hash")
+	assert.IsType(t, ErrNotFound{}, err)
+	keys, err = ims.GetAPIKeys(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestInMemory_Accounts(t *testing.T) {
+	ims := NewInMemory()
+	defer ims.Close(context.Background())
+	ctx := PutUser(context.Background(), User(1))
+	anonymousCtx := PutUser(context.Background(), User(2))
+
+	account := Account{Login: "alice", User: User(1), PasswordHash: "hash", CreatedAt: time.Now()}
+	assert.Nil(t, ims.SaveAccount(ctx, account))
+	assert.IsType(t, ErrConflict{}, ims.SaveAccount(ctx, Account{Login: "alice", User: User(3)}))
+	assert.IsType(t, ErrConflict{}, ims.SaveAccount(ctx, Account{Login: "bob", User: User(1)}))
+
+	saved, err := ims.GetAccount(ctx, "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, User(1), saved.User)
+	_, err = ims.GetAccount(ctx, "bob")
+	assert.IsType(t, ErrNotFound{}, err)
+
+	sid, err := ims.Put(anonymousCtx, FullURL("https://example.com/anonymous"), URLMeta{Creator: User(2)})
+	assert.Nil(t, err)
+	assert.Nil(t, ims.UpdateURL(anonymousCtx, sid, FullURL("https://example.com/updated")))
+
+	// registered users are never bound to others
+	assert.Nil(t, ims.BindUser(ctx, User(1), User(2)))
+	assert.Nil(t, ims.BindUser(ctx, User(2), User(1)))
+
+	// bound urls are created and changed by account user
+	assert.Nil(t, ims.UpdateURL(ctx, sid, FullURL("https://example.com/bound")))
+	history, err := ims.GetHistory(ctx, sid)
+	assert.Nil(t, err)
+	for _, entry := range history {
+		assert.Equal(t, User(1), entry.User)
+	}
+
+	urls, err := ims.GetURLs(ctx, URLsQuery{})
+	assert.Nil(t, err)
+	if assert.Len(t, urls, 1) {
+		assert.Equal(t, sid, urls[0].Sid)
+	}
+	_, err = ims.GetURLs(anonymousCtx, URLsQuery{})
+	assert.IsType(t, ErrNotFound{}, err)
+}
+
+// deleteURLs deletes urls of user and waits for the job to be done
+func deleteURLs(t *testing.T, stor Storage, ctx context.Context, sids []ShortID) []ShortID {
+	id, err := stor.DeleteURLs(ctx, sids)
+	assert.Nil(t, err)
+
+	job := DeleteJob{}
+	assert.Eventually(t, func() bool {
+		job, err = stor.GetDeleteJob(ctx, id)
+		return err == nil && job.Done()
+	}, time.Second, time.Millisecond)
+
+	return job.Deleted
+}
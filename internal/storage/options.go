@@ -0,0 +1,22 @@
+package storage
+
+type options struct {
+	idStrategy IDStrategy
+}
+
+type Option func(o *options)
+
+func WithIDStrategy(strategy IDStrategy) Option {
+	return func(o *options) {
+		o.idStrategy = strategy
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{idStrategy: IDStrategyHash}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
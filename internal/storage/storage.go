@@ -1,20 +1,66 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
-type BatchRequest map[CorrelationID]FullURL
+// sweepInterval is how often storages hide expired urls
+const sweepInterval = time.Minute
+
+type BatchURL struct {
+	URL  FullURL
+	Meta URLMeta
+}
+
+type BatchRequest map[CorrelationID]BatchURL
 type BatchResponse map[CorrelationID]ShortID
 type SavedURLs map[ShortID]FullURL
 
 type Storage interface {
 	Get(ctx context.Context, sid ShortID) (FullURL, error)
-	Save(ctx context.Context, sid ShortID, furl FullURL) error
-	Put(ctx context.Context, furl FullURL) (ShortID, error)
+	Save(ctx context.Context, sid ShortID, furl FullURL, meta URLMeta) error
+	Put(ctx context.Context, furl FullURL, meta URLMeta) (ShortID, error)
 	PutBatch(ctx context.Context, batch BatchRequest) (BatchResponse, error)
-	GetURLs(ctx context.Context) (SavedURLs, error)
-	AsyncDeleteURLs(ctx context.Context, sids []ShortID) []ShortID
-	DeleteURLs(ctx context.Context, sids []ShortID) error
+	GetURLs(ctx context.Context, query URLsQuery) ([]UserURL, error)
+	UpdateURL(ctx context.Context, sid ShortID, furl FullURL) error
+	GetHistory(ctx context.Context, sid ShortID) ([]HistoryEntry, error)
+	// SetTags replaces tags of user's url, tags are sorted and unique
+	SetTags(ctx context.Context, sid ShortID, tags []string) error
+	GetTags(ctx context.Context) ([]TagCount, error)
+	// DeleteURLs starts deletion of user's urls, which is tracked by returned job
+	DeleteURLs(ctx context.Context, sids []ShortID) (JobID, error)
+	GetDeleteJob(ctx context.Context, id JobID) (DeleteJob, error)
+	// GetDeletedURLs returns user's urls deleted after since
+	GetDeletedURLs(ctx context.Context, since time.Time) ([]DeletedURL, error)
+	// RestoreURLs restores user's urls deleted after since
+	RestoreURLs(ctx context.Context, sids []ShortID, since time.Time) (SavedURLs, error)
+	// PurgeDeleted permanently removes urls deleted, delete jobs done and api keys revoked before the given time,
+	// purged ShortIDs are either freed or kept blocked from reuse
+	PurgeDeleted(ctx context.Context, before time.Time, keepBlocked bool) (PurgeStats, error)
+	SaveClicks(ctx context.Context, clicks []Clicks) error
+	GetStats(ctx context.Context, sid ShortID) (URLStats, error)
+	SaveClickEvents(ctx context.Context, events []ClickEvent) error
+	GetAnalytics(ctx context.Context, query AnalyticsQuery) ([]AnalyticsBucket, error)
+	PurgeClickEvents(ctx context.Context, before time.Time) (int64, error)
+	// SaveAPIKey saves new key of user and returns its ID
+	SaveAPIKey(ctx context.Context, key APIKey) (APIKeyID, error)
+	// GetAPIKeys returns user's keys, which are not revoked
+	GetAPIKeys(ctx context.Context) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id APIKeyID) error
+	// GetAPIKey returns key by hash of its token, revoked keys are not found
+	GetAPIKey(ctx context.Context, hash string) (APIKey, error)
+	// SaveAccount registers account of user, logins are unique and user has at most one account
+	SaveAccount(ctx context.Context, account Account) error
+	GetAccount(ctx context.Context, login string) (Account, error)
+	// BindUser moves urls, tags, api keys and delete jobs of anonymous user from to user to,
+	// users with account are never moved
+	BindUser(ctx context.Context, from, to User) error
 	NewUser(ctx context.Context) (User, error)
 	AddUser(ctx context.Context, user User)
 	Ping(ctx context.Context) bool
+	// PendingMigrations returns names of schema migrations which are not applied yet
+	PendingMigrations(ctx context.Context) []string
+	// Close finishes background work, e.g. queued deletes, and releases resources
+	Close(ctx context.Context) error
 }
@@ -0,0 +1,12 @@
+package storage
+
+import "time"
+
+// Account binds login and password to user, so user survives lost cookies.
+// Only hash of password is kept
+type Account struct {
+	Login        string    `json:"login"`
+	User         User      `json:"user"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
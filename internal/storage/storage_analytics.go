@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// ClickEvent is a single redirect, IP is expected to be already anonymized
+type ClickEvent struct {
+	Sid       ShortID   `json:"id"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+}
+
+type AnalyticsGroup string
+
+const (
+	GroupByDay      = AnalyticsGroup("day")
+	GroupByReferrer = AnalyticsGroup("referrer")
+	GroupByAgent    = AnalyticsGroup("agent")
+)
+
+// AnalyticsQuery selects events of Sid within [From, To)
+type AnalyticsQuery struct {
+	Sid     ShortID
+	From    time.Time
+	To      time.Time
+	GroupBy AnalyticsGroup
+}
+
+type AnalyticsBucket struct {
+	Key      string
+	Clicks   int64
+	Visitors int64
+}
+
+const analyticsDayLayout = "2006-01-02"
+
+func (q AnalyticsQuery) match(ev ClickEvent) bool {
+	return ev.Sid == q.Sid && !ev.Time.Before(q.From) && ev.Time.Before(q.To)
+}
+
+func (q AnalyticsQuery) key(ev ClickEvent) string {
+	switch q.GroupBy {
+	case GroupByReferrer:
+		return ev.Referrer
+	case GroupByAgent:
+		return ev.UserAgent
+	}
+
+	return ev.Time.UTC().Format(analyticsDayLayout)
+}
+
+// aggregate groups events the same way as database does:
+// days in chronological order, referrers and agents from the most clicked
+func (q AnalyticsQuery) aggregate(events []ClickEvent) []AnalyticsBucket {
+	buckets := map[string]*AnalyticsBucket{}
+	visitors := map[string]map[string]struct{}{}
+
+	for _, ev := range events {
+		if !q.match(ev) {
+			continue
+		}
+
+		key := q.key(ev)
+		bucket, exist := buckets[key]
+		if !exist {
+			bucket = &AnalyticsBucket{Key: key}
+			buckets[key] = bucket
+			visitors[key] = map[string]struct{}{}
+		}
+		bucket.Clicks += 1
+		visitors[key][ev.IP] = struct{}{}
+	}
+
+	result := make([]AnalyticsBucket, 0, len(buckets))
+	for key, bucket := range buckets {
+		bucket.Visitors = int64(len(visitors[key]))
+		result = append(result, *bucket)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if q.GroupBy != GroupByDay && result[i].Clicks != result[j].Clicks {
+			return result[i].Clicks > result[j].Clicks
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
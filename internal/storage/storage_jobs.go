@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type JobID string
+
+// DeleteJob tracks deletion requested by user, it is done when every requested url
+// is either deleted or skipped as not owned by user or deleted already
+type DeleteJob struct {
+	ID        JobID     `json:"id"`
+	User      User      `json:"user"`
+	Requested []ShortID `json:"requested"`
+	Deleted   []ShortID `json:"deleted,omitempty"`
+	Skipped   []ShortID `json:"skipped,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	DoneAt    time.Time `json:"done_at"`
+}
+
+// newJobID is random, so jobs of replicas never clash
+func newJobID() JobID {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("storage: cannot read random job id: " + err.Error())
+	}
+
+	return JobID(hex.EncodeToString(b))
+}
+
+// newDeleteJob creates pending job for unique sids
+func newDeleteJob(user User, sids []ShortID, now time.Time) DeleteJob {
+	job := DeleteJob{ID: newJobID(), User: user, Requested: []ShortID{}, CreatedAt: now}
+
+	seen := map[ShortID]struct{}{}
+	for _, sid := range sids {
+		if _, exist := seen[sid]; !exist {
+			seen[sid] = struct{}{}
+			job.Requested = append(job.Requested, sid)
+		}
+	}
+
+	return job
+}
+
+func (j DeleteJob) Done() bool {
+	return !j.DoneAt.IsZero()
+}
+
+// finish splits requested urls into deleted and skipped ones
+func (j *DeleteJob) finish(deleted []ShortID, now time.Time) {
+	isDeleted := map[ShortID]struct{}{}
+	for _, sid := range deleted {
+		isDeleted[sid] = struct{}{}
+	}
+
+	j.Deleted, j.Skipped = []ShortID{}, []ShortID{}
+	for _, sid := range j.Requested {
+		if _, exist := isDeleted[sid]; exist {
+			j.Deleted = append(j.Deleted, sid)
+		} else {
+			j.Skipped = append(j.Skipped, sid)
+		}
+	}
+	j.DoneAt = now
+}
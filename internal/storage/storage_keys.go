@@ -0,0 +1,25 @@
+package storage
+
+import "time"
+
+type APIKeyID string
+
+// APIKey authenticates programmatic clients of user, only hash of its token is kept
+type APIKey struct {
+	ID        APIKeyID  `json:"id"`
+	User      User      `json:"user"`
+	Name      string    `json:"name,omitempty"`
+	Hash      string    `json:"hash"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// newAPIKeyID is random like job id, so keys of replicas never clash
+func newAPIKeyID() APIKeyID {
+	return APIKeyID(newJobID())
+}
+
+func (k APIKey) Revoked() bool {
+	return !k.RevokedAt.IsZero()
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+type URLsSort string
+
+const (
+	SortByCreated URLsSort = "created"
+	SortByClicks  URLsSort = "clicks"
+)
+
+// URLsCursor is the sort key of the last url of previous page
+type URLsCursor struct {
+	Value int64
+	Sid   ShortID
+}
+
+// URLsQuery selects a page of user's urls, urls are ordered by sort key and ShortID.
+// Empty Tag selects urls with any tags
+type URLsQuery struct {
+	Sort     URLsSort
+	Desc     bool
+	Contains string
+	Tag      string
+	After    *URLsCursor
+	Limit    int
+}
+
+type UserURL struct {
+	Sid    ShortID
+	URL    FullURL
+	Meta   URLMeta
+	Clicks int64
+	Tags   []string
+}
+
+// Cursor returns position of url in pages sorted by given key,
+// creation time is truncated to microseconds as it is stored in database
+func (u UserURL) Cursor(by URLsSort) URLsCursor {
+	if by == SortByClicks {
+		return URLsCursor{Value: u.Clicks, Sid: u.Sid}
+	}
+
+	return URLsCursor{Value: u.Meta.CreatedAt.UnixMicro(), Sid: u.Sid}
+}
+
+func (c URLsCursor) before(o URLsCursor) bool {
+	if c.Value != o.Value {
+		return c.Value < o.Value
+	}
+
+	return c.Sid < o.Sid
+}
+
+func (q URLsQuery) less(a, b URLsCursor) bool {
+	if q.Desc {
+		return b.before(a)
+	}
+
+	return a.before(b)
+}
+
+func (q URLsQuery) match(u UserURL) bool {
+	if !strings.Contains(string(u.URL), q.Contains) {
+		return false
+	}
+
+	if q.Tag != "" {
+		i := sort.SearchStrings(u.Tags, q.Tag)
+		if i == len(u.Tags) || u.Tags[i] != q.Tag {
+			return false
+		}
+	}
+
+	return q.After == nil || q.less(*q.After, u.Cursor(q.Sort))
+}
+
+// page filters urls and returns the first page of them, only urls of the page are kept sorted
+func (q URLsQuery) page(urls []UserURL) []UserURL {
+	if q.Limit <= 0 {
+		matched := urls[:0]
+		for _, u := range urls {
+			if q.match(u) {
+				matched = append(matched, u)
+			}
+		}
+		sort.Slice(matched, func(i, j int) bool {
+			return q.less(matched[i].Cursor(q.Sort), matched[j].Cursor(q.Sort))
+		})
+		return matched
+	}
+
+	result := make([]UserURL, 0, q.Limit)
+	for _, u := range urls {
+		if !q.match(u) {
+			continue
+		}
+		cursor := u.Cursor(q.Sort)
+		i := sort.Search(len(result), func(i int) bool {
+			return q.less(cursor, result[i].Cursor(q.Sort))
+		})
+		if i == q.Limit {
+			continue
+		}
+		if len(result) < q.Limit {
+			result = append(result, UserURL{})
+		}
+		copy(result[i+1:], result[i:])
+		result[i] = u
+	}
+
+	return result
+}
+
+// createdIndex is cursors of user's urls sorted by creation
+type createdIndex []URLsCursor
+
+func (ci createdIndex) search(c URLsCursor) int {
+	return sort.Search(len(ci), func(i int) bool {
+		return !ci[i].before(c)
+	})
+}
+
+func (ci createdIndex) add(c URLsCursor) createdIndex {
+	i := ci.search(c)
+	if i < len(ci) && ci[i] == c {
+		return ci
+	}
+
+	ci = append(ci, URLsCursor{})
+	copy(ci[i+1:], ci[i:])
+	ci[i] = c
+
+	return ci
+}
+
+func (ci createdIndex) remove(c URLsCursor) createdIndex {
+	i := ci.search(c)
+	if i == len(ci) || ci[i] != c {
+		return ci
+	}
+
+	return append(ci[:i], ci[i+1:]...)
+}
+
+// walk visits urls after query cursor in query order until visit returns false
+func (ci createdIndex) walk(q URLsQuery, visit func(sid ShortID) bool) {
+	if q.Desc {
+		i := len(ci) - 1
+		if q.After != nil {
+			i = ci.search(*q.After) - 1
+		}
+		for ; i >= 0; i-- {
+			if !visit(ci[i].Sid) {
+				return
+			}
+		}
+		return
+	}
+
+	i := 0
+	if q.After != nil {
+		i = ci.search(*q.After)
+		if i < len(ci) && ci[i] == *q.After {
+			i++
+		}
+	}
+	for ; i < len(ci); i++ {
+		if !visit(ci[i].Sid) {
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import "time"
+
+// Clicks are redirects to a single url within a day
+type Clicks struct {
+	Sid   ShortID   `json:"-"`
+	Day   time.Time `json:"day"`
+	Count int64     `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+type DailyClicks struct {
+	Day   time.Time
+	Count int64
+}
+
+type URLStats struct {
+	Clicks     int64
+	FirstClick time.Time
+	LastClick  time.Time
+	Daily      []DailyClicks
+}
+
+// ClickDay truncates click time to its UTC day
+func ClickDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Add merges clicks of the same url into stats
+func (s *URLStats) Add(c Clicks) {
+	s.Clicks += c.Count
+	if s.FirstClick.IsZero() || c.First.Before(s.FirstClick) {
+		s.FirstClick = c.First
+	}
+	if c.Last.After(s.LastClick) {
+		s.LastClick = c.Last
+	}
+
+	day := ClickDay(c.Day)
+	for i := range s.Daily {
+		if s.Daily[i].Day.Equal(day) {
+			s.Daily[i].Count += c.Count
+			return
+		}
+	}
+	s.Daily = append(s.Daily, DailyClicks{Day: day, Count: c.Count})
+}
@@ -0,0 +1,69 @@
+package storage
+
+import "sort"
+
+// TagCount is number of user's urls marked by the tag
+type TagCount struct {
+	Tag  string
+	URLs int64
+}
+
+// tagIndex keeps tags of single user's urls in both directions
+type tagIndex struct {
+	byURL map[ShortID][]string
+	byTag map[string]map[ShortID]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{byURL: map[ShortID][]string{}, byTag: map[string]map[ShortID]struct{}{}}
+}
+
+// set replaces tags of url, tags are expected to be sorted and unique
+func (ti *tagIndex) set(sid ShortID, tags []string) {
+	ti.remove(sid)
+	if len(tags) == 0 {
+		return
+	}
+
+	ti.byURL[sid] = append([]string{}, tags...)
+	for _, tag := range tags {
+		sids, exist := ti.byTag[tag]
+		if !exist {
+			sids = map[ShortID]struct{}{}
+			ti.byTag[tag] = sids
+		}
+		sids[sid] = struct{}{}
+	}
+}
+
+func (ti *tagIndex) remove(sid ShortID) {
+	for _, tag := range ti.byURL[sid] {
+		delete(ti.byTag[tag], sid)
+		if len(ti.byTag[tag]) == 0 {
+			delete(ti.byTag, tag)
+		}
+	}
+	delete(ti.byURL, sid)
+}
+
+// count returns tags of urls accepted by filter ordered by tag
+func (ti *tagIndex) count(filter func(sid ShortID) bool) []TagCount {
+	result := []TagCount{}
+	for tag, sids := range ti.byTag {
+		tc := TagCount{Tag: tag}
+		for sid := range sids {
+			if filter(sid) {
+				tc.URLs++
+			}
+		}
+		if tc.URLs > 0 {
+			result = append(result, tc)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Tag < result[j].Tag
+	})
+
+	return result
+}
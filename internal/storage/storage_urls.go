@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/shomali11/util/xhashes"
 )
@@ -12,6 +14,13 @@ func (e ErrConflict) Error() string {
 	return "Storage: conflict keys"
 }
 
+// ErrCollision means that ShortID is already taken by another FullURL
+type ErrCollision struct{}
+
+func (e ErrCollision) Error() string {
+	return "Storage: short id taken by another url"
+}
+
 type ErrInvalidShortID struct{}
 
 func (e ErrInvalidShortID) Error() string {
@@ -24,12 +33,63 @@ func (e ErrNotFound) Error() string {
 	return "Storage: url not found"
 }
 
+// ErrNotCreator means url is shared with user, but only its creator may change it
+type ErrNotCreator struct{}
+
+func (e ErrNotCreator) Error() string {
+	return "Storage: url is created by another user"
+}
+
+type ErrExpired struct{}
+
+func (e ErrExpired) Error() string {
+	return "Storage: url expired"
+}
+
 type ErrDeleted struct{}
 
 func (e ErrDeleted) Error() string {
 	return "Storage: url got deleted"
 }
 
+// URLMeta is optional data saved along with FullURL
+type URLMeta struct {
+	CreatedAt time.Time
+	// UpdatedAt is when destination was changed last time
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+	Creator   User
+	Title     string
+	Note      string
+	// Tags are set for user saving url along with it, they are expected to be sorted and unique
+	Tags []string
+}
+
+func (m URLMeta) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// DeletedURL is soft deleted url which may be restored
+type DeletedURL struct {
+	Sid       ShortID
+	URL       FullURL
+	DeletedAt time.Time
+}
+
+// PurgeStats counts what got permanently removed by purge
+type PurgeStats struct {
+	URLs      int64
+	Relations int64
+}
+
+// HistoryEntry is a single change of url destination
+type HistoryEntry struct {
+	User      User
+	ChangedAt time.Time
+	OldURL    FullURL
+	NewURL    FullURL
+}
+
 type FullURL string
 type CorrelationID string
 type ShortID int64
@@ -63,7 +123,30 @@ func Short(furl FullURL) ShortID {
 	return ShortID(xhashes.FNV64a(string(furl)))
 }
 
-func ParseShort(stringedShort string) (ShortID, error) {
+// SaltedShort returns salt-th candidate ShortID for furl. The chain is deterministic,
+// so the same url always walks the same candidates and finds its own ShortID again.
+func SaltedShort(furl FullURL, salt int) ShortID {
+	if salt == 0 {
+		return Short(furl)
+	}
+
+	return ShortID(xhashes.FNV64a(fmt.Sprintf("%d#%s", salt, furl)))
+}
+
+// checkCollision compares saved url with new one for already taken ShortID
+func checkCollision(saved, furl FullURL) error {
+	if saved != furl {
+		return ErrCollision{}
+	}
+
+	return ErrConflict{}
+}
+
+func ParseShort(codec Codec, stringedShort string) (ShortID, error) {
+	if !isLegacyShort(codec, stringedShort) {
+		return codec.Decode(stringedShort)
+	}
+
 	s, err := strconv.ParseInt(stringedShort, 10, 64)
 	if err != nil {
 		return DefaultShortID, ErrInvalidShortID{}
@@ -3,10 +3,16 @@ package webhandler
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	service "github.com/alexdyukov/go-url-shortener/internal/service"
 	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
@@ -14,13 +20,35 @@ import (
 
 const userCookieName = "URL-Shortener-User"
 
+const (
+	apiKeysPath  = "/api/user/keys"
+	registerPath = "/api/user/register"
+	loginPath    = "/api/user/login"
+)
+
+// userCookieLifetime is renewed on every response, so only inactive users lose their cookies
+const userCookieLifetime = 30 * 24 * time.Hour
+
+var (
+	errInvalidCookie = errors.New("webhandler: user cookie is tampered or encrypted by unknown key")
+	errExpiredCookie = errors.New("webhandler: user cookie is expired")
+)
+
 func newAuthHandler(encryptor *Encryptor, repo service.Repository) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			requestContext := r.Context()
 
+			// api key takes precedence over cookie, so programmatic clients need no cookies.
+			// Other schemes, e.g. basic auth of proxy, are left to cookie
+			if token, bearer := bearerToken(r); bearer {
+				serveAPIKey(w, r, repo, next, token)
+				return
+			}
+
 			user, err := encryptor.GetUser(r)
-			if err != nil && r.Method != http.MethodGet {
+			// default user is given to readers only, so it is replaced by new user on writes, e.g. on register
+			if (err != nil || user == storage.DefaultUser) && r.Method != http.MethodGet {
 				user, err = repo.NewUser(requestContext)
 				if err != nil {
 					log.Println("webhandler: authhandler: cannot call repo.NewUser():", err.Error())
@@ -29,79 +57,247 @@ func newAuthHandler(encryptor *Encryptor, repo service.Repository) func(next htt
 				}
 			}
 
-			http.SetCookie(w, encryptor.Cookie(user))
+			http.SetCookie(w, encryptor.Cookie(user, isSecure(r)))
 			r = r.WithContext(storage.PutUser(requestContext, user))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// isSecure returns whether cookies of r should be sent over https only,
+// TLS may be terminated by proxy in front of shortener
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setUserCookie replaces user cookie, which is already set by authhandler, e.g. on login
+func (e *Encryptor) setUserCookie(w http.ResponseWriter, r *http.Request, user storage.User) {
+	cookies := []string{}
+	for _, cookie := range w.Header().Values("Set-Cookie") {
+		if !strings.HasPrefix(cookie, userCookieName+"=") {
+			cookies = append(cookies, cookie)
+		}
+	}
+	w.Header().Del("Set-Cookie")
+	for _, cookie := range cookies {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+
+	http.SetCookie(w, e.Cookie(user, isSecure(r)))
+}
+
+// bearerToken returns token of Bearer authorization of r
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	return strings.TrimSpace(token), strings.EqualFold(scheme, "Bearer")
+}
+
+// serveAPIKey serves request of api key with scope required by request method,
+// api keys cannot manage api keys and accounts
+func serveAPIKey(w http.ResponseWriter, r *http.Request, repo service.Repository, next http.Handler, token string) {
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, scopes, err := repo.Authenticate(r.Context(), token)
+	switch err.(type) {
+	case nil:
+	case service.ErrInvalidAPIKey:
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	default:
+		log.Println("webhandler: authhandler: cannot call repo.Authenticate():", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if isCookieOnly(r.URL.Path) || !hasScope(scopes, requiredScope(r)) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	next.ServeHTTP(w, r.WithContext(storage.PutUser(r.Context(), user)))
+}
+
+func isCookieOnly(path string) bool {
+	return strings.HasPrefix(path, apiKeysPath) || path == registerPath || path == loginPath
+}
+
+// requiredScope returns scope of api key required by r, empty one for public redirects
+func requiredScope(r *http.Request) string {
+	if isRedirect(r) {
+		return ""
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return service.ScopeRead
+	case http.MethodDelete:
+		return service.ScopeDelete
+	default:
+		return service.ScopeWrite
+	}
+}
+
+// isRedirect tells whether r is public redirect by short id, which is served to anyone
+func isRedirect(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) && strings.Count(r.URL.Path, "/") == 1 && r.URL.Path != "/"
+}
+
+func hasScope(scopes []string, scope string) bool {
+	if scope == "" {
+		return true
+	}
+
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EncryptKey is AES-128, AES-192 or AES-256 key of user cookies with its ID,
+// which is saved in cookie to find the key
+type EncryptKey struct {
+	ID  string
+	Key []byte
+}
+
+type encryptKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
 type Encryptor struct {
-	aesblock cipher.Block
-	key      []byte
+	// keys holds []encryptKey, the first one encrypts cookies
+	keys atomic.Value
 }
 
-func newEncryptor(key []byte) *Encryptor {
-	aesblock, err := aes.NewCipher(key)
-	if err != nil {
+func newEncryptor(keys []EncryptKey) *Encryptor {
+	e := &Encryptor{}
+	if err := e.setKeys(keys); err != nil {
 		log.Fatal("cannot initialize Encryptor:", err.Error())
 	}
 
-	return &Encryptor{key: key, aesblock: aesblock}
+	return e
 }
 
-func (e *Encryptor) GetUser(r *http.Request) (storage.User, error) {
-	cookiedUser, err := r.Cookie(userCookieName)
-	if err != nil {
-		return storage.DefaultUser, err
+func (e *Encryptor) current() []encryptKey {
+	keys, _ := e.keys.Load().([]encryptKey)
+	return keys
+}
+
+// setKeys replaces key ring, the first key encrypts cookies and the others only decrypt them,
+// so cookies of older keys are encrypted by the first one on the next response
+func (e *Encryptor) setKeys(keys []EncryptKey) error {
+	if len(keys) == 0 {
+		return errors.New("webhandler: no encrypt keys")
 	}
 
-	stringedUser, err := e.decode(cookiedUser.Value)
-	if err != nil {
-		return storage.DefaultUser, err
+	ring := []encryptKey{}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ".") {
+			return fmt.Errorf("webhandler: invalid encrypt key id %q", key.ID)
+		}
+
+		aesblock, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(aesblock)
+		if err != nil {
+			return err
+		}
+
+		ring = append(ring, encryptKey{id: key.ID, aead: aead})
 	}
+	e.keys.Store(ring)
 
-	user, err := storage.ParseUser(stringedUser)
+	return nil
+}
+
+func (e *Encryptor) GetUser(r *http.Request) (storage.User, error) {
+	cookiedUser, err := r.Cookie(userCookieName)
 	if err != nil {
 		return storage.DefaultUser, err
 	}
 
-	return user, nil
+	return e.open(cookiedUser.Value, time.Now())
 }
 
-func (e *Encryptor) Cookie(user storage.User) *http.Cookie {
+func (e *Encryptor) Cookie(user storage.User, secure bool) *http.Cookie {
+	now := time.Now()
+
 	return &http.Cookie{
-		Name:  userCookieName,
-		Value: e.encode(fmt.Sprint(user)),
+		Name:     userCookieName,
+		Value:    e.seal(user, now),
+		Path:     "/",
+		Expires:  now.Add(userCookieLifetime),
+		MaxAge:   int(userCookieLifetime.Seconds()),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
 	}
 }
 
-func (e *Encryptor) encode(str string) string {
-	decoded := []byte(str)
-	encoded := make([]byte, e.aesblock.BlockSize())
+// seal encrypts and authenticates user with issue and expiry time of token by the newest key
+func (e *Encryptor) seal(user storage.User, issuedAt time.Time) string {
+	key := e.current()[0]
+
+	token := make([]byte, 24)
+	binary.BigEndian.PutUint64(token[0:], uint64(user))
+	binary.BigEndian.PutUint64(token[8:], uint64(issuedAt.Unix()))
+	binary.BigEndian.PutUint64(token[16:], uint64(issuedAt.Add(userCookieLifetime).Unix()))
 
-	for len(encoded) > len(decoded) {
-		decoded = append(decoded, ' ')
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(token)+key.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("webhandler: cannot read random nonce: " + err.Error())
 	}
 
-	e.aesblock.Encrypt(encoded, decoded)
+	sealed := key.aead.Seal(nonce, nonce, token, []byte(userCookieName+key.id))
 
-	return base64.StdEncoding.EncodeToString(encoded)
+	return key.id + "." + base64.RawURLEncoding.EncodeToString(sealed)
 }
 
-func (e *Encryptor) decode(str string) (string, error) {
-	encoded, err := base64.StdEncoding.DecodeString(str)
+// open returns user of token sealed by key of the ring, which is not expired at now
+func (e *Encryptor) open(value string, now time.Time) (storage.User, error) {
+	id, encoded, found := strings.Cut(value, ".")
+	if !found {
+		return storage.DefaultUser, errInvalidCookie
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
 	if err != nil {
-		return "", err
+		return storage.DefaultUser, errInvalidCookie
 	}
 
-	decoded := make([]byte, e.aesblock.BlockSize())
+	for _, key := range e.current() {
+		if key.id != id {
+			continue
+		}
 
-	for len(decoded) > len(encoded) {
-		encoded = append(encoded, ' ')
-	}
+		nonceSize := key.aead.NonceSize()
+		if len(sealed) < nonceSize {
+			return storage.DefaultUser, errInvalidCookie
+		}
+
+		token, err := key.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(userCookieName+key.id))
+		if err != nil || len(token) != 24 {
+			return storage.DefaultUser, errInvalidCookie
+		}
 
-	e.aesblock.Decrypt(decoded, []byte(encoded))
+		expiresAt := time.Unix(int64(binary.BigEndian.Uint64(token[16:])), 0)
+		if !now.Before(expiresAt) {
+			return storage.DefaultUser, errExpiredCookie
+		}
+
+		return storage.User(binary.BigEndian.Uint64(token[0:])), nil
+	}
 
-	return string(decoded), nil
+	return storage.DefaultUser, errInvalidCookie
 }
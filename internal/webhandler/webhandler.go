@@ -6,31 +6,53 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 
 	service "github.com/alexdyukov/go-url-shortener/internal/service"
 	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
 	"github.com/gorilla/mux"
 )
 
+// idPattern matches encoded and legacy numeric short ids
+const idPattern = "{id:[-]?[0-9A-Za-z]+}"
+
 type WebHandler struct {
 	repo      service.Repository
 	router    *mux.Router
 	encryptor *Encryptor
 }
 
-func NewWebHandler(svc service.Repository, encryptKey string) *WebHandler {
+// NewWebHandler encrypts user cookies by the first of keys, the others only decrypt them
+func NewWebHandler(svc service.Repository, keys []EncryptKey) *WebHandler {
 	h := WebHandler{}
 	h.repo = svc
-	h.encryptor = newEncryptor([]byte(encryptKey))
+	h.encryptor = newEncryptor(keys)
 
 	router := mux.NewRouter()
-	router.HandleFunc("/{id:[-]?[0-9]+}", h.GetRoot).Methods("GET")
+	// probes go first, because their paths are matched by idPattern too
+	router.HandleFunc("/ping", h.Ping).Methods("GET")
+	router.HandleFunc("/readyz", h.Ping).Methods("GET")
+	router.HandleFunc("/healthz", h.Healthz).Methods("GET")
+	router.HandleFunc("/"+idPattern, h.GetRoot).Methods("GET")
 	router.HandleFunc("/", h.PostRoot).Methods("POST")
 	router.HandleFunc("/api/shorten", h.PostAPIShorten).Methods("POST")
 	router.HandleFunc("/api/shorten/batch", h.PostAPIShortenBatch).Methods("POST")
 	router.HandleFunc("/api/user/urls", h.GetAPIUserURLs).Methods("GET")
 	router.HandleFunc("/api/user/urls", h.DeleteAPIUserURLs).Methods("DELETE")
-	router.HandleFunc("/ping", h.Ping).Methods("GET")
+	router.HandleFunc("/api/user/urls/deleted", h.GetAPIUserURLsDeleted).Methods("GET")
+	router.HandleFunc("/api/user/urls/restore", h.PostAPIUserURLsRestore).Methods("POST")
+	router.HandleFunc("/api/user/urls/"+idPattern, h.PatchAPIUserURL).Methods("PATCH")
+	router.HandleFunc("/api/user/urls/"+idPattern+"/history", h.GetAPIUserURLHistory).Methods("GET")
+	router.HandleFunc("/api/user/urls/"+idPattern+"/tags", h.PutAPIUserURLTags).Methods("PUT")
+	router.HandleFunc("/api/user/urls/"+idPattern+"/stats", h.GetAPIUserURLStats).Methods("GET")
+	router.HandleFunc("/api/user/urls/"+idPattern+"/analytics", h.GetAPIUserURLAnalytics).Methods("GET")
+	router.HandleFunc("/api/user/tags", h.GetAPIUserTags).Methods("GET")
+	router.HandleFunc("/api/user/jobs/{id:[0-9a-f]+}", h.GetAPIUserJob).Methods("GET")
+	router.HandleFunc(apiKeysPath, h.PostAPIUserKeys).Methods("POST")
+	router.HandleFunc(apiKeysPath, h.GetAPIUserKeys).Methods("GET")
+	router.HandleFunc(apiKeysPath+"/{id:[0-9a-f]+}", h.DeleteAPIUserKey).Methods("DELETE")
+	router.HandleFunc(registerPath, h.PostAPIUserRegister).Methods("POST")
+	router.HandleFunc(loginPath, h.PostAPIUserLogin).Methods("POST")
 
 	h.router = router
 
@@ -40,12 +62,35 @@ func NewWebHandler(svc service.Repository, encryptKey string) *WebHandler {
 func (h *WebHandler) HTTPRouter() http.Handler {
 	ah := newAuthHandler(h.encryptor, h.repo)
 	handler := ah(h.router)
+	handler = h.migrationsHandler(handler)
 	handler = compressHandler(handler)
 	return handler
 }
 
+// migrationsHandler answers like readiness probe until storage migrations are done, probes are served anyway
+func (h *WebHandler) migrationsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping", "/readyz", "/healthz":
+		default:
+			if pending := h.repo.PendingMigrations(r.Context()); len(pending) > 0 {
+				writeNotReady(w, service.Readiness{Pending: pending})
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reload replaces key ring of user cookies, cookies of keys left in the ring stay valid
+func (h *WebHandler) Reload(keys []EncryptKey) error {
+	return h.encryptor.setKeys(keys)
+}
+
 func (h *WebHandler) GetRoot(w http.ResponseWriter, r *http.Request) {
-	url, err := h.repo.GetURL(r.Context(), mux.Vars(r)["id"])
+	visit := service.Visit{Referrer: r.Referer(), UserAgent: r.UserAgent(), RemoteAddr: r.RemoteAddr}
+	url, err := h.repo.GetURL(r.Context(), mux.Vars(r)["id"], visit)
 
 	switch err.(type) {
 	case nil:
@@ -55,7 +100,7 @@ func (h *WebHandler) GetRoot(w http.ResponseWriter, r *http.Request) {
 	case storage.ErrNotFound:
 		w.WriteHeader(http.StatusNotFound)
 		return
-	case storage.ErrDeleted:
+	case storage.ErrDeleted, storage.ErrExpired:
 		w.WriteHeader(http.StatusGone)
 		return
 	default:
@@ -108,15 +153,13 @@ func (h *WebHandler) PostAPIShorten(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	inputJSON := struct {
-		URL string `json:"url"`
-	}{}
+	inputJSON := service.ShortenRequest{}
 	if err := json.Unmarshal(body, &inputJSON); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	shortURL, err := h.repo.SaveURL(r.Context(), string(inputJSON.URL))
+	shortURL, err := h.repo.Shorten(r.Context(), inputJSON)
 	switch err.(type) {
 	case nil:
 		w.Header().Set("Content-Type", "application/json")
@@ -124,7 +167,11 @@ func (h *WebHandler) PostAPIShorten(w http.ResponseWriter, r *http.Request) {
 	case storage.ErrConflict:
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
-	case service.ErrInvalidURL:
+	case storage.ErrCollision:
+		// alias is taken by another url, do not expose it
+		w.WriteHeader(http.StatusConflict)
+		return
+	case service.ErrInvalidURL, service.ErrInvalidAlias, service.ErrInvalidExpiration, service.ErrInvalidDetails, service.ErrInvalidTags:
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	default:
@@ -160,7 +207,12 @@ func (h *WebHandler) PostAPIShortenBatch(w http.ResponseWriter, r *http.Request)
 	}
 
 	output, err := h.repo.SaveBatch(r.Context(), input)
-	if err != nil {
+	switch err.(type) {
+	case nil:
+	case service.ErrInvalidExpiration, service.ErrInvalidDetails, service.ErrInvalidTags:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
 		log.Println("webhandler: PostAPIShortenBatch: InternalServerError:", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -172,9 +224,23 @@ func (h *WebHandler) PostAPIShortenBatch(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *WebHandler) GetAPIUserURLs(w http.ResponseWriter, r *http.Request) {
-	urls, err := h.repo.GetURLs(r.Context())
+	query := r.URL.Query()
+	req := service.URLsRequest{Cursor: query.Get("cursor"), Sort: query.Get("sort"), Contains: query.Get("search"), Tag: query.Get("tag")}
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Limit = parsed
+	}
+
+	page, err := h.repo.GetURLs(r.Context(), req)
 	switch err.(type) {
 	case nil:
+	case service.ErrInvalidURLsQuery:
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	case storage.ErrNotFound:
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -184,12 +250,308 @@ func (h *WebHandler) GetAPIUserURLs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if page.Next != "" {
+		next := *r.URL
+		query.Set("cursor", page.Next)
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", "<"+next.RequestURI()+">; rel=\"next\"")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page.URLs)
+}
+
+func (h *WebHandler) GetAPIUserURLsDeleted(w http.ResponseWriter, r *http.Request) {
+	urls, err := h.repo.GetDeletedURLs(r.Context())
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserURLsDeleted: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "\t")
 	encoder.Encode(urls)
 }
 
+func (h *WebHandler) PostAPIUserURLsRestore(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("webhandler: PostAPIUserURLsRestore: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	input := []string{}
+	if err := json.Unmarshal(body, &input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	urls, err := h.repo.RestoreURLs(r.Context(), input)
+	switch err.(type) {
+	case nil:
+	case storage.ErrInvalidShortID:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: PostAPIUserURLsRestore: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urls)
+}
+
+func (h *WebHandler) PatchAPIUserURL(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("webhandler: PatchAPIUserURL: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	input := service.UpdateRequest{}
+	if err := json.Unmarshal(body, &input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	urls, err := h.repo.UpdateURL(r.Context(), mux.Vars(r)["id"], input)
+	switch err.(type) {
+	case nil:
+	case storage.ErrInvalidShortID, service.ErrInvalidURL:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case storage.ErrNotCreator:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case storage.ErrExpired:
+		w.WriteHeader(http.StatusGone)
+		return
+	default:
+		log.Println("webhandler: PatchAPIUserURL: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urls)
+}
+
+func (h *WebHandler) GetAPIUserURLHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := h.repo.GetHistory(r.Context(), mux.Vars(r)["id"])
+	switch err.(type) {
+	case nil:
+	case storage.ErrInvalidShortID:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserURLHistory: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func (h *WebHandler) PutAPIUserURLTags(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println("webhandler: PutAPIUserURLTags: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	input := []string{}
+	if err := json.Unmarshal(body, &input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tags, err := h.repo.SetTags(r.Context(), mux.Vars(r)["id"], input)
+	switch err.(type) {
+	case nil:
+	case storage.ErrInvalidShortID, service.ErrInvalidTags:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: PutAPIUserURLTags: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+func (h *WebHandler) GetAPIUserTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.repo.GetTags(r.Context())
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserTags: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+func (h *WebHandler) PostAPIUserKeys(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	input := service.APIKeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.repo.CreateAPIKey(r.Context(), input)
+	switch err.(type) {
+	case nil:
+	case service.ErrInvalidScopes:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: PostAPIUserKeys: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+func (h *WebHandler) GetAPIUserKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.repo.GetAPIKeys(r.Context())
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserKeys: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (h *WebHandler) DeleteAPIUserKey(w http.ResponseWriter, r *http.Request) {
+	err := h.repo.RevokeAPIKey(r.Context(), mux.Vars(r)["id"])
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: DeleteAPIUserKey: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *WebHandler) GetAPIUserURLStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.repo.GetStats(r.Context(), mux.Vars(r)["id"])
+	switch err.(type) {
+	case nil:
+	case storage.ErrInvalidShortID:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserURLStats: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *WebHandler) GetAPIUserURLAnalytics(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	analytics, err := h.repo.GetAnalytics(r.Context(), mux.Vars(r)["id"], query.Get("from"), query.Get("to"), query.Get("group_by"))
+	switch err.(type) {
+	case nil:
+	case storage.ErrInvalidShortID, service.ErrInvalidAnalyticsQuery:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserURLAnalytics: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
+
 func (h *WebHandler) DeleteAPIUserURLs(w http.ResponseWriter, r *http.Request) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "application/json" {
@@ -210,7 +572,7 @@ func (h *WebHandler) DeleteAPIUserURLs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.repo.DeleteURLs(r.Context(), input)
+	jobID, err := h.repo.DeleteURLs(r.Context(), input)
 	switch err.(type) {
 	case nil:
 	case storage.ErrNotFound:
@@ -222,11 +584,119 @@ func (h *WebHandler) DeleteAPIUserURLs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/user/jobs/"+jobID)
 	w.WriteHeader(http.StatusAccepted)
+
+	outputJSON := struct {
+		JobID string `json:"job_id"`
+	}{}
+	outputJSON.JobID = jobID
+	json.NewEncoder(w).Encode(outputJSON)
 }
 
+func (h *WebHandler) GetAPIUserJob(w http.ResponseWriter, r *http.Request) {
+	job, err := h.repo.GetDeleteJob(r.Context(), mux.Vars(r)["id"])
+	switch err.(type) {
+	case nil:
+	case storage.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		log.Println("webhandler: GetAPIUserJob: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// Ping is readiness probe, which lists pending migrations until storage is ready
 func (h *WebHandler) Ping(w http.ResponseWriter, r *http.Request) {
-	if !h.repo.Ping(r.Context()) {
-		w.WriteHeader(http.StatusServiceUnavailable)
+	readiness := h.repo.Readiness(r.Context())
+	if readiness.Ready {
+		return
+	}
+
+	writeNotReady(w, readiness)
+}
+
+func writeNotReady(w http.ResponseWriter, readiness service.Readiness) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(readiness)
+}
+
+// Healthz is liveness probe, which does not touch storage
+func (h *WebHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *WebHandler) PostAPIUserRegister(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
 	}
+
+	input := service.Credentials{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	account, err := h.repo.Register(r.Context(), input)
+	switch err.(type) {
+	case nil:
+	case service.ErrInvalidCredentials:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case storage.ErrConflict:
+		w.WriteHeader(http.StatusConflict)
+		return
+	case storage.ErrInvalidUser:
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	default:
+		log.Println("webhandler: PostAPIUserRegister: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(account)
+}
+
+func (h *WebHandler) PostAPIUserLogin(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	input := service.Credentials{}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.repo.Login(r.Context(), input)
+	switch err.(type) {
+	case nil:
+	case service.ErrInvalidCredentials:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	case service.ErrWrongCredentials:
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	default:
+		log.Println("webhandler: PostAPIUserLogin: InternalServerError:", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.encryptor.setUserCookie(w, r, user)
+	w.WriteHeader(http.StatusOK)
 }
@@ -3,6 +3,7 @@ package webhandler
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	service "github.com/alexdyukov/go-url-shortener/internal/service"
 	storage "github.com/alexdyukov/go-url-shortener/internal/storage"
@@ -22,6 +24,7 @@ const shuffleCounter = 100
 var baseURL string = "http://localhost:8080"
 var savedURL string = "https://www.google.com/search?q=there+is+search+string"
 var savedID string
+var legacySavedID string
 var nonsavedID string
 var testWebHandler *WebHandler
 var ctx context.Context
@@ -40,6 +43,8 @@ func TestMain(m *testing.M) {
 
 	ctx = storage.PutUser(ctx, user)
 
+	legacySavedID = fmt.Sprint(storage.Short(storage.FullURL(savedURL)))
+
 	savedURL, err := testService.SaveURL(ctx, savedURL)
 	if err != nil {
 		panic("cannot save predefined valid url:" + err.Error())
@@ -56,10 +61,12 @@ func TestMain(m *testing.M) {
 		panic("cannot generate valid but not saved ID")
 	}
 
-	testWebHandler = NewWebHandler(testService, "testtesttesttest")
+	testWebHandler = NewWebHandler(testService, []EncryptKey{{ID: "test", Key: []byte("testtesttesttest")}})
 
 	// Run tests
-	os.Exit(m.Run())
+	code := m.Run()
+	testService.Close(ctx)
+	os.Exit(code)
 }
 
 // non actual shuffle, just a little changing of input string
@@ -101,6 +108,14 @@ func TestWebHandler_GetRoot(t *testing.T) {
 				location:   savedURL,
 			},
 		},
+		{
+			name:    "test GET legacy numeric saved ID",
+			request: "/" + legacySavedID,
+			want: want{
+				statusCode: http.StatusTemporaryRedirect,
+				location:   savedURL,
+			},
+		},
 		{
 			name:    "test GET invalid param",
 			request: "/a",
@@ -186,6 +201,9 @@ func TestWebHandler_PostApiShorten(t *testing.T) {
 	type request struct {
 		contentType string `json:"-"`
 		URL         string `json:"url"`
+		Alias       string `json:"alias,omitempty"`
+		TTL         int64  `json:"ttl,omitempty"`
+		ExpiresAt   string `json:"expires_at,omitempty"`
 	}
 	tests := []struct {
 		name    string
@@ -200,7 +218,7 @@ func TestWebHandler_PostApiShorten(t *testing.T) {
 			},
 			want: want{
 				statusCode: http.StatusCreated,
-				response:   "{\"result\":\"" + baseURL + "/" + fmt.Sprint(storage.Short(storage.FullURL(savedURL+"TestWebHandler_PostApiShorten"))) + "\"}",
+				response:   "{\"result\":\"" + baseURL + "/" + storage.DefaultCodec.Encode(storage.Short(storage.FullURL(savedURL+"TestWebHandler_PostApiShorten"))) + "\"}",
 			},
 		},
 		{
@@ -225,6 +243,78 @@ func TestWebHandler_PostApiShorten(t *testing.T) {
 				response:   "",
 			},
 		},
+		{
+			name: "nonsaved alias",
+			request: request{
+				URL:         savedURL + "TestWebHandler_PostApiShorten_alias",
+				Alias:       "promo2022",
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusCreated,
+				response:   "{\"result\":\"" + baseURL + "/promo2022\"}",
+			},
+		},
+		{
+			name: "alias taken by another url",
+			request: request{
+				URL:         savedURL + "TestWebHandler_PostApiShorten_other",
+				Alias:       "promo2022",
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusConflict,
+				response:   "",
+			},
+		},
+		{
+			name: "reserved alias",
+			request: request{
+				URL:         savedURL,
+				Alias:       "api",
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+				response:   "",
+			},
+		},
+		{
+			name: "alias with invalid symbols",
+			request: request{
+				URL:         savedURL,
+				Alias:       "promo-2022",
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+				response:   "",
+			},
+		},
+		{
+			name: "nonsaved url with ttl",
+			request: request{
+				URL:         savedURL + "TestWebHandler_PostApiShorten_ttl",
+				TTL:         3600,
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusCreated,
+				response:   "",
+			},
+		},
+		{
+			name: "expiration in the past",
+			request: request{
+				URL:         savedURL + "TestWebHandler_PostApiShorten_expired",
+				ExpiresAt:   "2020-01-01T00:00:00Z",
+				contentType: "application/json",
+			},
+			want: want{
+				statusCode: http.StatusBadRequest,
+				response:   "",
+			},
+		},
 		{
 			name: "invalid content type",
 			request: request{
@@ -261,3 +351,949 @@ func TestWebHandler_PostApiShorten(t *testing.T) {
 		})
 	}
 }
+
+func TestWebHandler_GetAPIUserURLStats(t *testing.T) {
+	redirect := httptest.NewRequest(http.MethodGet, "/"+savedID, nil).WithContext(ctx)
+	testWebHandler.router.ServeHTTP(httptest.NewRecorder(), redirect)
+
+	type want struct {
+		statusCode int
+		minClicks  int64
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{
+			name:    "saved ID",
+			request: "/api/user/urls/" + savedID + "/stats",
+			want: want{
+				statusCode: http.StatusOK,
+				minClicks:  1,
+			},
+		},
+		{
+			name:    "non saved ID",
+			request: "/api/user/urls/" + nonsavedID + "/stats",
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.request, nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			if tt.want.statusCode != http.StatusOK {
+				return
+			}
+
+			stats := service.Stats{}
+			assert.Nil(t, json.NewDecoder(result.Body).Decode(&stats))
+			assert.GreaterOrEqual(t, stats.Clicks, tt.want.minClicks)
+			assert.NotEmpty(t, stats.Daily)
+			assert.NotNil(t, stats.LastClick)
+		})
+	}
+}
+
+func TestWebHandler_GetAPIUserURLAnalytics(t *testing.T) {
+	referrer := "https://example.com/TestWebHandler_GetAPIUserURLAnalytics"
+	redirect := httptest.NewRequest(http.MethodGet, "/"+savedID, nil).WithContext(ctx)
+	redirect.Header.Set("Referer", referrer)
+	testWebHandler.router.ServeHTTP(httptest.NewRecorder(), redirect)
+
+	// click events are written asynchronously
+	assert.Eventually(t, func() bool {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls/"+savedID+"/analytics?group_by=referrer", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		testWebHandler.router.ServeHTTP(w, r)
+		return strings.Contains(w.Body.String(), referrer)
+	}, 3*time.Second, 10*time.Millisecond)
+
+	type want struct {
+		statusCode int
+		key        string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{
+			name:    "group by referrer",
+			request: "/api/user/urls/" + savedID + "/analytics?group_by=referrer",
+			want: want{
+				statusCode: http.StatusOK,
+				key:        referrer,
+			},
+		},
+		{
+			name:    "group by day",
+			request: "/api/user/urls/" + savedID + "/analytics?from=2020-01-01",
+			want: want{
+				statusCode: http.StatusOK,
+				key:        time.Now().UTC().Format("2006-01-02"),
+			},
+		},
+		{
+			name:    "invalid group",
+			request: "/api/user/urls/" + savedID + "/analytics?group_by=pikachu",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:    "non saved ID",
+			request: "/api/user/urls/" + nonsavedID + "/analytics",
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.request, nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			if tt.want.statusCode != http.StatusOK {
+				return
+			}
+
+			analytics := service.Analytics{}
+			assert.Nil(t, json.NewDecoder(result.Body).Decode(&analytics))
+
+			keys := []string{}
+			for _, group := range analytics.Groups {
+				keys = append(keys, group.Key)
+			}
+			assert.Contains(t, keys, tt.want.key)
+		})
+	}
+}
+
+func TestWebHandler_PatchAPIUserURL(t *testing.T) {
+	oldURL := "https://example.com/TestWebHandler_PatchAPIUserURL"
+	newURL := "https://example.org/TestWebHandler_PatchAPIUserURL"
+
+	shortURL, err := testWebHandler.repo.SaveURL(ctx, oldURL)
+	assert.Nil(t, err)
+	editedID := strings.TrimPrefix(shortURL, baseURL+"/")
+
+	type want struct {
+		statusCode int
+		location   string
+	}
+	tests := []struct {
+		name    string
+		id      string
+		request string
+		want    want
+	}{
+		{
+			name:    "edit saved ID",
+			id:      editedID,
+			request: `{"url":"` + newURL + `"}`,
+			want: want{
+				statusCode: http.StatusOK,
+				location:   newURL,
+			},
+		},
+		{
+			name:    "empty url",
+			id:      editedID,
+			request: `{"url":""}`,
+			want: want{
+				statusCode: http.StatusBadRequest,
+				location:   newURL,
+			},
+		},
+		{
+			name:    "non saved ID",
+			id:      nonsavedID,
+			request: `{"url":"` + newURL + `"}`,
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+tt.id, strings.NewReader(tt.request)).WithContext(ctx)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			if tt.want.location == "" {
+				return
+			}
+
+			r = httptest.NewRequest(http.MethodGet, "/"+tt.id, nil).WithContext(ctx)
+			w = httptest.NewRecorder()
+			testWebHandler.router.ServeHTTP(w, r)
+			assert.Equal(t, tt.want.location, w.Result().Header.Get("Location"))
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/user/urls/"+editedID+"/history", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	result := w.Result()
+	defer result.Body.Close()
+
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	history := []service.HistoryItem{}
+	assert.Nil(t, json.NewDecoder(result.Body).Decode(&history))
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, oldURL, history[0].OldURL)
+		assert.Equal(t, newURL, history[0].NewURL)
+	}
+}
+
+func TestWebHandler_PatchAPIUserURLOfOtherUser(t *testing.T) {
+	sharedURL := "https://example.com/TestWebHandler_PatchAPIUserURLOfOtherUser"
+	newURL := "https://example.org/TestWebHandler_PatchAPIUserURLOfOtherUser"
+
+	shortURL, err := testWebHandler.repo.SaveURL(ctx, sharedURL)
+	assert.Nil(t, err)
+	sharedID := strings.TrimPrefix(shortURL, baseURL+"/")
+
+	// another user shortens the same url and gets it shared
+	other, err := testWebHandler.repo.NewUser(ctx)
+	assert.Nil(t, err)
+	otherCtx := storage.PutUser(context.Background(), other)
+	shared, err := testWebHandler.repo.SaveBatch(otherCtx, []service.BatchRequestItem{{CorrelationID: "1", OriginalURL: sharedURL}})
+	assert.Nil(t, err)
+	assert.Len(t, shared, 1)
+
+	r := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+sharedID, strings.NewReader(`{"url":"`+newURL+`"}`)).WithContext(otherCtx)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	r = httptest.NewRequest(http.MethodGet, "/"+sharedID, nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, sharedURL, w.Result().Header.Get("Location"))
+}
+
+func TestWebHandler_PostAPIUserURLsRestore(t *testing.T) {
+	shortURL, err := testWebHandler.repo.SaveURL(ctx, "https://example.com/TestWebHandler_PostAPIUserURLsRestore")
+	assert.Nil(t, err)
+	deletedID := strings.TrimPrefix(shortURL, baseURL+"/")
+	body := `["` + deletedID + `"]`
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	// deletion is asynchronous
+	assert.Eventually(t, func() bool {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls/deleted", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		testWebHandler.router.ServeHTTP(w, r)
+		return w.Result().StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	tests := []struct {
+		name       string
+		request    string
+		statusCode int
+	}{
+		{
+			name:       "restore deleted ID",
+			request:    body,
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "restore twice",
+			request:    body,
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "invalid ID",
+			request:    `["!"]`,
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/user/urls/restore", strings.NewReader(tt.request)).WithContext(ctx)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+		})
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/"+deletedID, nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Result().StatusCode)
+}
+
+func TestWebHandler_GetAPIUserJob(t *testing.T) {
+	shortURL, err := testWebHandler.repo.SaveURL(ctx, "https://example.com/TestWebHandler_GetAPIUserJob")
+	assert.Nil(t, err)
+	deletedID := strings.TrimPrefix(shortURL, baseURL+"/")
+	body := `["` + deletedID + `", "` + nonsavedID + `"]`
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/user/urls", strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+
+	accepted := struct {
+		JobID string `json:"job_id"`
+	}{}
+	assert.Nil(t, json.NewDecoder(w.Result().Body).Decode(&accepted))
+	assert.NotEmpty(t, accepted.JobID)
+	assert.Equal(t, "/api/user/jobs/"+accepted.JobID, w.Result().Header.Get("Location"))
+
+	job := service.DeleteJob{}
+	assert.Eventually(t, func() bool {
+		r := httptest.NewRequest(http.MethodGet, "/api/user/jobs/"+accepted.JobID, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		testWebHandler.router.ServeHTTP(w, r)
+		if w.Result().StatusCode != http.StatusOK {
+			return false
+		}
+		job = service.DeleteJob{}
+		return json.NewDecoder(w.Result().Body).Decode(&job) == nil && job.Status == service.JobDone
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, accepted.JobID, job.ID)
+	assert.NotNil(t, job.DoneAt)
+	assert.Equal(t, []string{deletedID}, job.Deleted)
+	assert.Equal(t, []string{nonsavedID}, job.Skipped)
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		id         string
+		statusCode int
+	}{
+		{
+			name:       "unknown job",
+			ctx:        ctx,
+			id:         "0123456789abcdef",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			name:       "job of another user",
+			ctx:        storage.PutUser(context.Background(), storage.User(1<<40)),
+			id:         accepted.JobID,
+			statusCode: http.StatusNotFound,
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/user/jobs/"+tt.id, nil).WithContext(tt.ctx)
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+		})
+	}
+}
+
+func TestWebHandler_GetAPIUserURLs(t *testing.T) {
+	type want struct {
+		statusCode int
+		minURLs    int
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{
+			name:    "default page",
+			request: "/api/user/urls",
+			want: want{
+				statusCode: http.StatusOK,
+				minURLs:    1,
+			},
+		},
+		{
+			name:    "sorted by clicks",
+			request: "/api/user/urls?sort=-clicks&limit=1",
+			want: want{
+				statusCode: http.StatusOK,
+				minURLs:    1,
+			},
+		},
+		{
+			name:    "unknown sort",
+			request: "/api/user/urls?sort=name",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:    "invalid limit",
+			request: "/api/user/urls?limit=-1",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:    "invalid cursor",
+			request: "/api/user/urls?cursor=invalid",
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:    "nothing found",
+			request: "/api/user/urls?search=TestWebHandler_GetAPIUserURLs",
+			want: want{
+				statusCode: http.StatusNoContent,
+			},
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.request, nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			if tt.want.statusCode != http.StatusOK {
+				return
+			}
+
+			urls := []service.URLs{}
+			assert.Nil(t, json.NewDecoder(result.Body).Decode(&urls))
+			assert.GreaterOrEqual(t, len(urls), tt.want.minURLs)
+		})
+	}
+}
+
+func TestWebHandler_PutAPIUserURLTags(t *testing.T) {
+	shortURL, err := testWebHandler.repo.SaveURL(ctx, "https://example.com/TestWebHandler_PutAPIUserURLTags")
+	assert.Nil(t, err)
+	taggedID := strings.TrimPrefix(shortURL, baseURL+"/")
+
+	type want struct {
+		statusCode int
+		tags       []string
+	}
+	tests := []struct {
+		name    string
+		id      string
+		request string
+		want    want
+	}{
+		{
+			name:    "tag saved ID",
+			id:      taggedID,
+			request: `["Spring-Sale", "newsletter", "spring-sale"]`,
+			want: want{
+				statusCode: http.StatusOK,
+				tags:       []string{"newsletter", "spring-sale"},
+			},
+		},
+		{
+			name:    "invalid tag",
+			id:      taggedID,
+			request: `["spring sale"]`,
+			want: want{
+				statusCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name:    "non saved ID",
+			id:      nonsavedID,
+			request: `["newsletter"]`,
+			want: want{
+				statusCode: http.StatusNotFound,
+			},
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/user/urls/"+tt.id+"/tags", strings.NewReader(tt.request)).WithContext(ctx)
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			if tt.want.statusCode != http.StatusOK {
+				return
+			}
+
+			tags := []string{}
+			assert.Nil(t, json.NewDecoder(result.Body).Decode(&tags))
+			assert.Equal(t, tt.want.tags, tags)
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/user/tags", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	result := w.Result()
+	defer result.Body.Close()
+
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	tags := []service.TagItem{}
+	assert.Nil(t, json.NewDecoder(result.Body).Decode(&tags))
+	assert.Contains(t, tags, service.TagItem{Tag: "spring-sale", URLs: 1})
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/urls?tag=spring-sale", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	filtered := w.Result()
+	defer filtered.Body.Close()
+
+	assert.Equal(t, http.StatusOK, filtered.StatusCode)
+	urls := []service.URLs{}
+	assert.Nil(t, json.NewDecoder(filtered.Body).Decode(&urls))
+	if assert.Len(t, urls, 1) {
+		assert.Equal(t, shortURL, urls[0].Short)
+		assert.Equal(t, []string{"newsletter", "spring-sale"}, urls[0].Tags)
+		assert.True(t, urls[0].Own)
+	}
+}
+
+func TestWebHandler_PostApiShortenTagsOnConflict(t *testing.T) {
+	taggedURL := "https://example.com/TestWebHandler_PostApiShortenTagsOnConflict"
+	shortURL, err := testWebHandler.repo.SaveURL(ctx, taggedURL)
+	assert.Nil(t, err)
+
+	// shorten of already saved url still tags it
+	r := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"`+taggedURL+`","tags":["reshortened"]}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/urls?tag=reshortened", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	result := w.Result()
+	defer result.Body.Close()
+
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	urls := []service.URLs{}
+	assert.Nil(t, json.NewDecoder(result.Body).Decode(&urls))
+	if assert.Len(t, urls, 1) {
+		assert.Equal(t, shortURL, urls[0].Short)
+	}
+}
+
+func TestWebHandler_Probes(t *testing.T) {
+	for _, probe := range []string{"/ping", "/readyz", "/healthz"} {
+		t.Run(probe, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, probe, nil).WithContext(ctx)
+			w := httptest.NewRecorder()
+
+			testWebHandler.router.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, http.StatusOK, result.StatusCode)
+		})
+	}
+}
+
+// migratingStorage is storage, which migrations are never done
+type migratingStorage struct {
+	storage.Storage
+}
+
+func (s migratingStorage) PendingMigrations(_ context.Context) []string {
+	return []string{"users table"}
+}
+
+func TestWebHandler_ProbesWithPendingMigrations(t *testing.T) {
+	stor := migratingStorage{Storage: storage.NewInMemory()}
+	svc := service.NewURLShortener(stor, baseURL)
+	defer svc.Close(context.Background())
+	handler := NewWebHandler(svc, []EncryptKey{{ID: "test", Key: []byte("testtesttesttest")}}).HTTPRouter()
+
+	for _, path := range []string{"/readyz", "/api/user/urls"} {
+		t.Run(path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, http.StatusServiceUnavailable, result.StatusCode)
+			assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+			readiness := service.Readiness{}
+			assert.Nil(t, json.NewDecoder(result.Body).Decode(&readiness))
+			assert.Equal(t, service.Readiness{Ready: false, Pending: []string{"users table"}}, readiness)
+		})
+	}
+
+	// liveness does not depend on storage
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestEncryptor_SetKeys(t *testing.T) {
+	oldKey := EncryptKey{ID: "old", Key: []byte("testtesttesttest")}
+	newKey := EncryptKey{ID: "new", Key: []byte("newkeynewkeynewkeynewkeynewkey32")}
+
+	encryptor := newEncryptor([]EncryptKey{oldKey})
+	user := storage.User(42)
+	oldCookie := encryptor.Cookie(user, false)
+
+	assert.NotNil(t, encryptor.setKeys([]EncryptKey{}))
+	assert.NotNil(t, encryptor.setKeys([]EncryptKey{{ID: "short", Key: []byte("short")}}))
+	assert.NotNil(t, encryptor.setKeys([]EncryptKey{{ID: "dot.ted", Key: newKey.Key}}))
+	assert.Nil(t, encryptor.setKeys([]EncryptKey{newKey, oldKey}))
+
+	newCookie := encryptor.Cookie(user, false)
+	assert.True(t, strings.HasPrefix(newCookie.Value, "new."))
+
+	for _, cookie := range []*http.Cookie{oldCookie, newCookie} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookie)
+		got, err := encryptor.GetUser(r)
+		assert.Nil(t, err)
+		assert.Equal(t, user, got)
+	}
+
+	// cookies of keys removed from the ring are rejected
+	assert.Nil(t, encryptor.setKeys([]EncryptKey{newKey}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(oldCookie)
+	_, err := encryptor.GetUser(r)
+	assert.Equal(t, errInvalidCookie, err)
+}
+
+func TestEncryptor_Cookie(t *testing.T) {
+	encryptor := newEncryptor([]EncryptKey{{ID: "test", Key: []byte("testtesttesttest")}})
+	user := storage.User(42)
+	now := time.Now()
+
+	cookie := encryptor.Cookie(user, true)
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	assert.Equal(t, "/", cookie.Path)
+	assert.NotEqual(t, cookie.Value, encryptor.Cookie(user, true).Value)
+
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(cookie.Value, "test."))
+	assert.Nil(t, err)
+	sealed[len(sealed)-1] ^= 1
+	tampered := "test." + base64.RawURLEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name  string
+		value string
+		now   time.Time
+		user  storage.User
+		err   error
+	}{
+		{
+			name:  "valid",
+			value: cookie.Value,
+			now:   now,
+			user:  user,
+		},
+		{
+			name:  "expired",
+			value: encryptor.seal(user, now.Add(-userCookieLifetime)),
+			now:   now,
+			user:  storage.DefaultUser,
+			err:   errExpiredCookie,
+		},
+		{
+			name:  "tampered",
+			value: tampered,
+			now:   now,
+			user:  storage.DefaultUser,
+			err:   errInvalidCookie,
+		},
+		{
+			name:  "unknown key id",
+			value: "other" + strings.TrimPrefix(cookie.Value, "test"),
+			now:   now,
+			user:  storage.DefaultUser,
+			err:   errInvalidCookie,
+		},
+		{
+			name:  "raw aes block",
+			value: "AAAAAAAAAAAAAAAAAAAAAA",
+			now:   now,
+			user:  storage.DefaultUser,
+			err:   errInvalidCookie,
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encryptor.open(tt.value, tt.now)
+			assert.Equal(t, tt.err, err)
+			assert.Equal(t, tt.user, got)
+		})
+	}
+}
+
+func TestWebHandler_APIUserKeys(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/user/keys", strings.NewReader(`{"name": "ci", "scopes": ["unknown"]}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/user/keys", strings.NewReader(`{"name": "ci", "scopes": ["read", "READ"]}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	key := service.APIKey{}
+	assert.Nil(t, json.NewDecoder(w.Result().Body).Decode(&key))
+	assert.Equal(t, []string{service.ScopeRead}, key.Scopes)
+	assert.NotEmpty(t, key.Key)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/user/keys", strings.NewReader(`{"name": "writer", "scopes": ["write"]}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	writer := service.APIKey{}
+	assert.Nil(t, json.NewDecoder(w.Result().Body).Decode(&writer))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/keys", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	listed := []service.APIKey{}
+	assert.Nil(t, json.NewDecoder(w.Result().Body).Decode(&listed))
+	if assert.Len(t, listed, 2) {
+		assert.Equal(t, key.ID, listed[0].ID)
+		assert.Empty(t, listed[0].Key)
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		authorization string
+		statusCode    int
+		cookie        bool
+	}{
+		{
+			name:          "read scope",
+			method:        http.MethodGet,
+			target:        "/api/user/urls",
+			authorization: "Bearer " + key.Key,
+			statusCode:    http.StatusOK,
+		},
+		{
+			name:          "missing write scope",
+			method:        http.MethodPost,
+			target:        "/api/shorten",
+			authorization: "Bearer " + key.Key,
+			statusCode:    http.StatusForbidden,
+		},
+		{
+			name:          "keys are managed by cookie users only",
+			method:        http.MethodGet,
+			target:        "/api/user/keys",
+			authorization: "Bearer " + key.Key,
+			statusCode:    http.StatusForbidden,
+		},
+		{
+			name:          "unknown key",
+			method:        http.MethodGet,
+			target:        "/api/user/urls",
+			authorization: "Bearer usk_unknown",
+			statusCode:    http.StatusUnauthorized,
+		},
+		{
+			name:          "not bearer is left to cookie",
+			method:        http.MethodGet,
+			target:        "/api/user/urls",
+			authorization: "Basic " + key.Key,
+			statusCode:    http.StatusNoContent,
+			cookie:        true,
+		},
+		{
+			name:          "redirect needs no scope",
+			method:        http.MethodGet,
+			target:        "/" + savedID,
+			authorization: "Bearer " + writer.Key,
+			statusCode:    http.StatusTemporaryRedirect,
+		},
+	}
+
+	// run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Header.Set("Authorization", tt.authorization)
+			w := httptest.NewRecorder()
+
+			testWebHandler.HTTPRouter().ServeHTTP(w, r)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+			assert.Equal(t, tt.cookie, len(result.Cookies()) > 0)
+		})
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/user/keys/"+key.ID, nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	testWebHandler.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	r.Header.Set("Authorization", "Bearer "+key.Key)
+	w = httptest.NewRecorder()
+	testWebHandler.HTTPRouter().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestWebHandler_APIUserAccount(t *testing.T) {
+	handler := testWebHandler.HTTPRouter()
+	serve := func(method, target, body string, cookie *http.Cookie) *http.Response {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+	userCookie := func(resp *http.Response) *http.Cookie {
+		cookies := []*http.Cookie{}
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == userCookieName {
+				cookies = append(cookies, cookie)
+			}
+		}
+		if assert.Len(t, cookies, 1) {
+			return cookies[0]
+		}
+		return nil
+	}
+
+	// anonymous user registers with its links
+	resp := serve(http.MethodPost, "/api/shorten", `{"url": "https://example.com/registered"}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	registered := userCookie(resp)
+
+	resp = serve(http.MethodPost, "/api/user/register", `{"login": "Alice", "password": "short"}`, registered)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = serve(http.MethodPost, "/api/user/register", `{"login": "Alice", "password": "alice password"}`, registered)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	account := service.Account{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&account))
+	assert.Equal(t, "alice", account.Login)
+
+	resp = serve(http.MethodPost, "/api/user/register", `{"login": "alice", "password": "other password"}`, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// another anonymous user logs in, so its links are bound to account
+	resp = serve(http.MethodPost, "/api/shorten", `{"url": "https://example.com/anonymous"}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	anonymous := userCookie(resp)
+
+	resp = serve(http.MethodPost, "/api/user/login", `{"login": "alice", "password": "wrong password"}`, anonymous)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = serve(http.MethodPost, "/api/user/login", `{"login": "bob", "password": "bob password"}`, anonymous)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = serve(http.MethodPost, "/api/user/login", `{"login": "alice", "password": "alice password"}`, anonymous)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	loggedIn := userCookie(resp)
+
+	user, err := testWebHandler.encryptor.open(loggedIn.Value, time.Now())
+	assert.Nil(t, err)
+	registeredUser, err := testWebHandler.encryptor.open(registered.Value, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, registeredUser, user)
+
+	resp = serve(http.MethodGet, "/api/user/urls", "", loggedIn)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	urls := []map[string]interface{}{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&urls))
+	assert.Len(t, urls, 2)
+
+	resp = serve(http.MethodGet, "/api/user/urls", "", anonymous)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestWebHandler_PostAPIUserRegisterOfDefaultUser(t *testing.T) {
+	handler := testWebHandler.HTTPRouter()
+
+	// reader without cookie gets default user
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user/urls", nil))
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	user, err := testWebHandler.encryptor.open(cookies[0].Value, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, storage.DefaultUser, user)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/user/register", strings.NewReader(`{"login": "default", "password": "default password"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	cookies = w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	user, err = testWebHandler.encryptor.open(cookies[0].Value, time.Now())
+	assert.Nil(t, err)
+	assert.NotEqual(t, storage.DefaultUser, user)
+}